@@ -0,0 +1,210 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Addon is a component installed on a running cluster, from a Helm chart or from manifests.
+type Addon struct {
+	Name        string
+	Description string
+	// Chart, Repo and Version select the Helm chart of the addon, released as Release in Namespace.
+	Chart   string
+	Repo    string
+	Version string
+	// Release is the name of the Helm release, Name by default. It prefixes the names of the chart workloads.
+	Release string
+	// Values are passed to helm with --set.
+	Values []string
+	// Manifests are applied with kubectl when the addon is not a Helm chart.
+	Manifests []string
+	Namespace string
+	// DependsOn are the addons installed before this one.
+	DependsOn []string
+	// Ready are the workloads, like deployment/metrics-server, whose rollout must be complete for the addon to be
+	// healthy. They live in Namespace.
+	Ready []string
+}
+
+// addonRegistry are the addons which can be enabled on a cluster. The ingress controller and the LoadBalancer
+// services support are not addons: they take parameters, reconfigure Cilium and the LB and are kept in their own
+// fields of the cluster state, see InstallIngress and InstallServiceLB.
+var addonRegistry = []Addon{
+	{
+		Name:        "metrics-server",
+		Description: "resource metrics for kubectl top and the autoscalers",
+		Chart:       "metrics-server",
+		Repo:        "https://kubernetes-sigs.github.io/metrics-server/",
+		Version:     "3.11.0",
+		// the kubelet serving certificates are self-signed on kubeadm clusters
+		Values:    []string{"args={--kubelet-insecure-tls}"},
+		Namespace: "kube-system",
+		Ready:     []string{"deployment/metrics-server"},
+	},
+	{
+		Name:        "local-path-provisioner",
+		Description: "local-path storage class backed by the node disks, not the default one",
+		// the manifest does not mark the local-path class as the default one, the NFS storage class can be
+		Manifests: []string{
+			"https://raw.githubusercontent.com/rancher/local-path-provisioner/v0.0.26/deploy/local-path-storage.yaml",
+		},
+		Namespace: "local-path-storage",
+		Ready:     []string{"deployment/local-path-provisioner"},
+	},
+	{
+		Name:        "cert-manager",
+		Description: "certificates management",
+		Chart:       "cert-manager",
+		Repo:        "https://charts.jetstack.io",
+		Version:     "v1.13.3",
+		Values:      []string{"installCRDs=true"},
+		Namespace:   "cert-manager",
+		Ready:       []string{"deployment/cert-manager", "deployment/cert-manager-webhook", "deployment/cert-manager-cainjector"},
+	},
+	{
+		Name:        "dashboard",
+		Description: "kubernetes dashboard, with the resource metrics",
+		Chart:       "kubernetes-dashboard",
+		Repo:        "https://kubernetes.github.io/dashboard/",
+		// named after the chart, the workloads are not prefixed by the release name
+		Release:   "kubernetes-dashboard",
+		Version:   "6.0.8",
+		Namespace: "kubernetes-dashboard",
+		DependsOn: []string{"metrics-server"},
+		Ready:     []string{"deployment/kubernetes-dashboard"},
+	},
+}
+
+// AddonStatus is the state of an addon of the registry on a cluster.
+type AddonStatus struct {
+	Addon     Addon
+	Installed bool
+	Healthy   bool
+}
+
+// findAddon returns the addon of the registry with the given name, or nil.
+func findAddon(registry []Addon, name string) *Addon {
+	for i := range registry {
+		if registry[i].Name == name {
+			return &registry[i]
+		}
+	}
+	return nil
+}
+
+// resolveAddons returns the addons to install to enable the given ones, dependencies first. Returns ErrUnknownAddon
+// if an addon is not in the registry and ErrAddonCycle if dependencies loop.
+func resolveAddons(registry []Addon, names []string) ([]Addon, error) {
+	var ordered []Addon
+	// visiting holds the addons being resolved, to detect cycles
+	var visiting []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		if slices.ContainsFunc(ordered, func(addon Addon) bool { return addon.Name == name }) {
+			return nil
+		}
+		if slices.Contains(visiting, name) {
+			return ErrAddonCycle
+		}
+		addon := findAddon(registry, name)
+		if addon == nil {
+			Logger.Debug("unknown addon", "addon", name)
+			return ErrUnknownAddon
+		}
+		visiting = append(visiting, name)
+		for _, dependency := range addon.DependsOn {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		visiting = visiting[:len(visiting)-1]
+		ordered = append(ordered, *addon)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// installCmd returns the command installing the addon, run from the first control node.
+func (addon Addon) installCmd() string {
+	if addon.Chart == "" {
+		return "kubectl apply -f " + strings.Join(addon.Manifests, " -f ")
+	}
+	release := addon.Release
+	if release == "" {
+		release = addon.Name
+	}
+	cmd := fmt.Sprintf("helm upgrade --install %s %s --repo %s --namespace %s --create-namespace", release,
+		addon.Chart, addon.Repo, addon.Namespace)
+	if addon.Version != "" {
+		cmd += " --version " + addon.Version
+	}
+	for _, value := range addon.Values {
+		cmd += fmt.Sprintf(" --set '%s'", value)
+	}
+	return cmd
+}
+
+// isReady checks the rollout of the addon workloads, waiting up to timeout, eg: 5m.
+func (addon Addon) isReady(vmName string, timeout string) bool {
+	for _, workload := range addon.Ready {
+		cmd := []string{"kubectl", "-n", addon.Namespace, "rollout", "status", workload, "--timeout=" + timeout}
+		if _, err := RunCmd(vmName, cmd); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// EnableAddons installs the given addons and their dependencies, waits for them to be healthy and records them in
+// the cluster state. Installed addons are installed again, which upgrades them to the registry version.
+func (cluster *Cluster) EnableAddons(names ...string) error {
+	addons, err := resolveAddons(addonRegistry, names)
+	if err != nil {
+		return err
+	}
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	for _, addon := range addons {
+		if slices.Contains(cluster.InstalledAddons, addon.Name) && !slices.Contains(names, addon.Name) {
+			// dependencies already installed are left untouched
+			continue
+		}
+		Logger.Info("installing addon", "addon", addon.Name, "cluster", cluster.Name)
+		if out, err := RunCmd(firstCtrlName, []string{"sh", "-c", addon.installCmd()}); err != nil {
+			Logger.Error("unable to install addon", "err", err, "output", out, "addon", addon.Name)
+			return err
+		}
+		if !addon.isReady(firstCtrlName, "5m") {
+			Logger.Error("addon is not healthy", "addon", addon.Name, "cluster", cluster.Name)
+			return ErrAddonNotReady
+		}
+		if !slices.Contains(cluster.InstalledAddons, addon.Name) {
+			cluster.InstalledAddons = append(cluster.InstalledAddons, addon.Name)
+		}
+		if err := cluster.SaveState(); err != nil {
+			return err
+		}
+		Logger.Info("addon installed", "addon", addon.Name, "cluster", cluster.Name)
+	}
+	return nil
+}
+
+// AddonsStatus returns the state of every addon of the registry on the cluster. Only installed addons are checked.
+func (cluster *Cluster) AddonsStatus() []AddonStatus {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	statuses := make([]AddonStatus, 0, len(addonRegistry))
+	for _, addon := range addonRegistry {
+		status := AddonStatus{Addon: addon, Installed: slices.Contains(cluster.InstalledAddons, addon.Name)}
+		if status.Installed {
+			status.Healthy = addon.isReady(firstCtrlName, "5s")
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResolveAddons(t *testing.T) {
+	registry := []Addon{
+		{Name: "a"},
+		{Name: "b", DependsOn: []string{"a"}},
+		{Name: "c", DependsOn: []string{"b", "a"}},
+		{Name: "loop1", DependsOn: []string{"loop2"}},
+		{Name: "loop2", DependsOn: []string{"loop1"}},
+	}
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr error
+	}{
+		{name: "addons_no_dependency", names: []string{"a"}, want: []string{"a"}},
+		{name: "addons_dependencies_first", names: []string{"c"}, want: []string{"a", "b", "c"}},
+		{name: "addons_no_duplicate", names: []string{"b", "a", "c"}, want: []string{"a", "b", "c"}},
+		{name: "addons_unknown", names: []string{"d"}, wantErr: ErrUnknownAddon},
+		{name: "addons_cycle", names: []string{"loop1"}, wantErr: ErrAddonCycle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addons, err := resolveAddons(registry, tt.names)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("resolveAddons() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var got []string
+			for _, addon := range addons {
+				got = append(got, addon.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveAddons() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddonRegistry(t *testing.T) {
+	for _, addon := range addonRegistry {
+		if _, err := resolveAddons(addonRegistry, []string{addon.Name}); err != nil {
+			t.Errorf("addon %s does not resolve: %v", addon.Name, err)
+		}
+		if (addon.Chart == "") == (len(addon.Manifests) == 0) {
+			t.Errorf("addon %s should be either a Helm chart or manifests", addon.Name)
+		}
+		if addon.Namespace == "" || len(addon.Ready) == 0 {
+			t.Errorf("addon %s has no readiness check", addon.Name)
+		}
+	}
+}
+
+func TestAddon_installCmd(t *testing.T) {
+	dashboard := findAddon(addonRegistry, "dashboard")
+	want := "helm upgrade --install kubernetes-dashboard kubernetes-dashboard --repo https://kubernetes.github.io/dashboard/ " +
+		"--namespace kubernetes-dashboard --create-namespace --version 6.0.8"
+	if got := dashboard.installCmd(); got != want {
+		t.Errorf("installCmd() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// DefaultKubernetesVersion is the kubernetes version pinned by install.sh.
+	DefaultKubernetesVersion = "1.25.5"
+	// artifactsChecksumsFile lists the sha256 of every file of an artifact cache, relative to the cache directory.
+	artifactsChecksumsFile = "SHA256SUMS"
+	// artifactsArchFile holds the debian architecture of the artifacts of a cache, eg: arm64. Caches pulled before it
+	// was written are amd64.
+	artifactsArchFile = "arch"
+	// artifactsEnvPath is the file, written by cloud init, which switches install.sh to the offline mode.
+	artifactsEnvPath = "/etc/kmpass/artifacts.env"
+	// artifactsBuilderName is the temporary VM downloading the artifacts of kmpass cache pull.
+	artifactsBuilderName = "kmpass-cache-builder"
+	// defaultArtifactsPort is the port of the host artifact server when its address is not set.
+	defaultArtifactsPort = 8775
+	// crictlVersion and helmVersion are the versions of the binaries installed by install.sh.
+	crictlVersion = "v1.25.0"
+	helmVersion   = "v3.9.0"
+)
+
+// artifactPackages are the packages installed on the VMs next to kubernetes and containerd, by cloud init or the LB
+// install scripts, cached for the offline mode.
+var artifactPackages = []string{"nfs-common", "nfs-kernel-server", "haproxy", "socat", "keepalived", "nginx",
+	"libnginx-mod-stream", "netcat-openbsd"}
+
+// multipassBridges are the host interfaces of the multipass network, by backend: qemu, lxd and the macOS vmnet.
+var multipassBridges = []string{"mpqemubr0", "mpbr0", "bridge100", "bridge101"}
+
+// cachePullConfig is the data of the cache pull script template.
+type cachePullConfig struct {
+	Version       string
+	KubeVersion   string
+	AptVersion    string
+	CrictlVersion string
+	HelmVersion   string
+	Packages      []string
+	Images        []string
+}
+
+// ArtifactCacheDir returns the host directory of the artifact cache of a kubernetes version, ~/kmpass/cache/v1.25.5.
+func ArtifactCacheDir(version string) (string, error) {
+	kubeVersion, err := ParseKubeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	kmpassDir, err := KmpassDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(kmpassDir, "cache", kubeVersion.String()), nil
+}
+
+// normalizeImage returns the fully qualified reference of an image, as expected by ctr, eg: nginx becomes
+// docker.io/library/nginx:latest.
+func normalizeImage(image string) string {
+	name := image
+	if first, _, found := strings.Cut(image, "/"); !found {
+		name = "docker.io/library/" + image
+	} else if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		name = "docker.io/" + image
+	}
+	if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") && !strings.Contains(name, "@") {
+		name += ":latest"
+	}
+	return name
+}
+
+// PullArtifacts downloads once on the host, in the artifact cache of a kubernetes version, everything install.sh
+// fetches from the internet: the debs of kubernetes, containerd and the packages of the VMs, crictl, helm and the
+// cilium CLI, and the kubeadm, cilium and extra images. The download runs in a temporary VM of the nodes image, so
+// that only the packages missing from the image are cached. Returns the cache directory.
+func PullArtifacts(version string, image string, extraImages []string) (string, error) {
+	kubeVersion, err := ParseKubeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := ArtifactCacheDir(version)
+	if err != nil {
+		return "", err
+	}
+	config := cachePullConfig{
+		Version:       version,
+		KubeVersion:   kubeVersion.String(),
+		AptVersion:    kubeVersion.aptVersion(),
+		CrictlVersion: crictlVersion,
+		HelmVersion:   helmVersion,
+		Packages:      artifactPackages,
+	}
+	// kube-vip is pulled by the control nodes of the kube-vip mode, offline it must be in the containerd store
+	config.Images = append(config.Images, kubeVIPImage)
+	for _, extra := range extraImages {
+		config.Images = append(config.Images, normalizeImage(extra))
+	}
+	scriptPath, err := renderTemplate("app/files/cache-pull.sh.tpl", "cache-pull.sh", config)
+	if err != nil {
+		return "", err
+	}
+
+	builder, err := NewInstanceConfig(2, "4G", "20G", image, artifactsBuilderName, "")
+	if err != nil {
+		return "", err
+	}
+	if !builder.Exist() {
+		if err := builder.Create(); err != nil {
+			return "", err
+		}
+	}
+	defer func() {
+		if err := builder.Delete(); err != nil {
+			Logger.Warn("unable to delete the artifacts builder vm", "err", err, "instance-name", builder.Name)
+		}
+	}()
+	if err := Transfer(builder.Name, scriptPath, "cache-pull.sh"); err != nil {
+		return "", err
+	}
+	Logger.Info("downloading the artifacts", "instance-name", builder.Name, "version", kubeVersion.String())
+	if out, err := RunCmd(builder.Name, []string{"sudo", "bash", "/tmp/cache-pull.sh"}); err != nil {
+		Logger.Error("unable to download the artifacts", "err", err, "output", out, "instance-name", builder.Name)
+		return "", err
+	}
+
+	if err := os.RemoveAll(cacheDir); err != nil {
+		Logger.Error("unable to clean the artifact cache", "err", err, "path", cacheDir)
+		return "", err
+	}
+	if err := os.MkdirAll(cacheDir, 0770); err != nil {
+		Logger.Error("unable to create the artifact cache", "err", err, "path", cacheDir)
+		return "", ErrCreateFile
+	}
+	archivePath := filepath.Join(cacheDir, "..", kubeVersion.String()+".tar.gz")
+	if err := TransferFrom(builder.Name, "/tmp/kmpass-cache.tar.gz", archivePath); err != nil {
+		return "", err
+	}
+	defer os.Remove(archivePath)
+	if out, err := exec.Command("tar", "xzf", archivePath, "-C", cacheDir).CombinedOutput(); err != nil {
+		Logger.Error("unable to extract the artifacts", "err", err, "output", string(out), "path", archivePath)
+		return "", err
+	}
+	if err := VerifyArtifacts(cacheDir); err != nil {
+		return "", err
+	}
+	return cacheDir, nil
+}
+
+// VerifyArtifacts checks the files of an artifact cache against its checksums file.
+func VerifyArtifacts(cacheDir string) error {
+	checksums, err := os.Open(filepath.Join(cacheDir, artifactsChecksumsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrArtifactsNotFound
+		}
+		Logger.Error("unable to read the artifact checksums", "err", err, "path", cacheDir)
+		return err
+	}
+	defer checksums.Close()
+	scanner := bufio.NewScanner(checksums)
+	for scanner.Scan() {
+		sum, name, found := strings.Cut(scanner.Text(), "  ")
+		if !found {
+			return ErrArtifactChecksum
+		}
+		file, err := os.Open(filepath.Join(cacheDir, name))
+		if err != nil {
+			Logger.Error("artifact is missing", "err", err, "artifact", name)
+			return ErrArtifactChecksum
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil || hex.EncodeToString(hash.Sum(nil)) != sum {
+			Logger.Error("artifact checksum mismatch", "err", err, "artifact", name)
+			return ErrArtifactChecksum
+		}
+	}
+	return scanner.Err()
+}
+
+// artifactsArch returns the debian architecture of the artifacts of a cache.
+func artifactsArch(cacheDir string) string {
+	content, err := os.ReadFile(filepath.Join(cacheDir, artifactsArchFile))
+	if err != nil {
+		return "amd64"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// ValidateOffline checks that the cluster does not use features which download from the internet, and are not in the
+// artifact cache: the Envoy LB, the storage, the registry, the pull-through cache, the ingress controllers and the
+// addons.
+func (cluster *Cluster) ValidateOffline() error {
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"envoy", cluster.LBMode == LBModeEnvoy},
+		{"storage", cluster.Storage != ""},
+		{"registry", cluster.Registry != ""},
+		{"pull-cache", cluster.PullCache},
+		{"ingress", cluster.Ingress != ""},
+		{"addons", len(cluster.Addons) > 0},
+	}
+	for _, feature := range features {
+		if feature.enabled {
+			Logger.Error("feature cannot be used offline", "feature", feature.name, "cluster", cluster.Name)
+			return ErrOfflineFeature
+		}
+	}
+	return nil
+}
+
+// sandboxImage returns the pause image of the artifact cache, which containerd must use as it cannot pull its
+// default one offline.
+func sandboxImage(cacheDir string) string {
+	content, err := os.ReadFile(filepath.Join(cacheDir, "images", "images.txt"))
+	if err != nil {
+		return ""
+	}
+	for _, image := range strings.Fields(string(content)) {
+		if strings.Contains(image, "/pause:") {
+			return image
+		}
+	}
+	return ""
+}
+
+// hostBridgeNetwork returns the address of the host on the multipass network, reachable from the VMs, and the
+// network mask.
+func hostBridgeNetwork() (*net.IPNet, error) {
+	for _, name := range multipassBridges {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				return ipNet, nil
+			}
+		}
+	}
+	return nil, ErrNoMultipassBridge
+}
+
+// ServeArtifacts serves the artifact cache of a kubernetes version over HTTP to the VMs, on addr or on the multipass
+// bridge of the host if addr is empty, and sets the cluster in offline mode. The server runs until the process exits.
+func (cluster *Cluster) ServeArtifacts(version string, addr string) error {
+	cacheDir, err := ArtifactCacheDir(version)
+	if err != nil {
+		return err
+	}
+	if err := VerifyArtifacts(cacheDir); err != nil {
+		return err
+	}
+	// multipass VMs run the architecture of the host
+	if arch := artifactsArch(cacheDir); arch != runtime.GOARCH {
+		Logger.Error("artifact cache architecture mismatch", "arch", arch, "host-arch", runtime.GOARCH, "path", cacheDir)
+		return ErrArtifactsArch
+	}
+	if addr == "" {
+		bridge, err := hostBridgeNetwork()
+		if err != nil {
+			return err
+		}
+		addr = fmt.Sprintf("%s:%d", bridge.IP, defaultArtifactsPort)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Logger.Error("unable to listen for the artifact server", "err", err, "addr", addr)
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, http.FileServer(http.Dir(cacheDir))); err != nil {
+			Logger.Error("artifact server stopped", "err", err, "addr", addr)
+		}
+	}()
+	kubeVersion, _ := ParseKubeVersion(version)
+	cluster.ArtifactsURL = "http://" + addr
+	cluster.ArtifactsVersion = strings.TrimPrefix(kubeVersion.String(), "v")
+	Logger.Info("serving the artifact cache", "url", cluster.ArtifactsURL, "path", cacheDir)
+	return nil
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx", want: "docker.io/library/nginx:latest"},
+		{image: "nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "bitnami/redis:7.2", want: "docker.io/bitnami/redis:7.2"},
+		{image: "ghcr.io/org/app", want: "ghcr.io/org/app:latest"},
+		{image: "localhost:5000/app:dev", want: "localhost:5000/app:dev"},
+		{image: "registry.k8s.io/pause:3.8", want: "registry.k8s.io/pause:3.8"},
+		{image: "quay.io/cilium/cilium@sha256:abcd", want: "quay.io/cilium/cilium@sha256:abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := normalizeImage(tt.image); got != tt.want {
+				t.Errorf("normalizeImage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyArtifacts(t *testing.T) {
+	// sha256 of "kmpass\n"
+	const sum = "b31523c1980311d02c2d97fc0891cb892c43e652dc972274506ddd2889e3cdf5"
+	tests := []struct {
+		name      string
+		content   string
+		checksums string
+		wantErr   error
+	}{
+		{
+			name:      "valid",
+			content:   "kmpass\n",
+			checksums: sum + "  bin/tool.tar.gz\n",
+		},
+		{
+			name:      "corrupted",
+			content:   "kmpass2\n",
+			checksums: sum + "  bin/tool.tar.gz\n",
+			wantErr:   ErrArtifactChecksum,
+		},
+		{
+			name:      "missing_file",
+			content:   "kmpass\n",
+			checksums: sum + "  bin/other.tar.gz\n",
+			wantErr:   ErrArtifactChecksum,
+		},
+		{
+			name:    "no_cache",
+			content: "kmpass\n",
+			wantErr: ErrArtifactsNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "bin"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "bin", "tool.tar.gz"), []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.checksums != "" {
+				if err := os.WriteFile(filepath.Join(dir, artifactsChecksumsFile), []byte(tt.checksums), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := VerifyArtifacts(dir); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyArtifacts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCluster_ValidateOffline(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster *Cluster
+		wantErr bool
+	}{
+		{name: "haproxy", cluster: &Cluster{LBMode: LBModeHaproxy}},
+		{name: "kube_vip", cluster: &Cluster{LBMode: LBModeKubeVIP}},
+		{name: "envoy", cluster: &Cluster{LBMode: LBModeEnvoy}, wantErr: true},
+		{name: "storage", cluster: &Cluster{Storage: "lb"}, wantErr: true},
+		{name: "registry", cluster: &Cluster{Registry: "vm"}, wantErr: true},
+		{name: "pull_cache", cluster: &Cluster{PullCache: true}, wantErr: true},
+		{name: "ingress", cluster: &Cluster{Ingress: "cilium"}, wantErr: true},
+		{name: "addons", cluster: &Cluster{Addons: []string{"metrics-server"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cluster.ValidateOffline(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateOffline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArtifactsArch(t *testing.T) {
+	dir := t.TempDir()
+	if got := artifactsArch(dir); got != "amd64" {
+		t.Errorf("artifactsArch() = %v, want amd64 without arch file", got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, artifactsArchFile), []byte("arm64\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := artifactsArch(dir); got != "arm64" {
+		t.Errorf("artifactsArch() = %v, want arm64", got)
+	}
+}
@@ -1,8 +1,11 @@
 package app
 
 import (
+	"encoding/base64"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 )
 
@@ -11,14 +14,37 @@ import (
 type BootstrapConfig struct {
 	// Base64 encoded node bootstrap script. Can leverage EncodeFileB64 function for that
 	NodeBootstrapScript string
+	// Packages are extra apt packages installed on the VMs.
+	Packages []string
+	// Files are written on the VMs before the bootstrap script runs.
+	Files []BootstrapFile
+	// SSHAuthorizedKeys are the public keys authorized on the ubuntu user.
+	SSHAuthorizedKeys []string
+	// CACerts are PEM certificates trusted by the VMs, indented for the cloud init file.
+	CACerts []string
+	// Offline disables the packages update of cloud init, the packages are installed from the host artifact cache.
+	Offline bool
 	// @TODO, set kube version
 	// KubeVersion string
 }
 
+// BootstrapFile is a file written on the VMs by cloud init.
+type BootstrapFile struct {
+	Path string
+	// Base64 encoded content of the file.
+	Content string
+	// Append adds the content at the end of the file instead of replacing it.
+	Append bool
+}
+
+// supportCloudInitFileName is the cloud init file of the VMs which do not join the cluster.
+const supportCloudInitFileName = "cloudinit-support.yaml"
+
 // updateCloudinitNodes updates the nodes cloudinit file. There is a placeholder in this cloudinit file for a
 // bootstrap shell script which install the prerequisites for kubernetes. This script can be updated with some
-// parameters like Kubernetes version. Returns the cloud init file path in the local machine or an error.
-func (config BootstrapConfig) updateCloudinit() (string, error) {
+// parameters like Kubernetes version. The file is written to ~/kmpass/outFileName. Returns the cloud init file path
+// in the local machine or an error.
+func (config BootstrapConfig) updateCloudinit(outFileName string) (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		Logger.Error("cannot get home dir", err)
@@ -34,7 +60,7 @@ func (config BootstrapConfig) updateCloudinit() (string, error) {
 		Logger.Error("unable to load Go template file file", err, "filename", "files/clouds.yaml.tpl")
 		return "", ErrLoadTemplate
 	}
-	outFilePath := filepath.Join(homeDir, "kmpass", "cloudinit.yaml")
+	outFilePath := filepath.Join(homeDir, "kmpass", outFileName)
 	outFile, err := os.Create(outFilePath)
 	if err != nil {
 		Logger.Error("unable to create file", err, "path", outFilePath)
@@ -47,9 +73,17 @@ func (config BootstrapConfig) updateCloudinit() (string, error) {
 	return outFilePath, nil
 }
 
-// GenerateConfigLB generates configuration files used to bootstrap the cluster load balancer.
+// GenerateConfigLB generates configuration files used to bootstrap the cluster load balancer, with the load balancer
+// implementation selected by the cluster LB mode.
 func GenerateConfigLB(cluster *Cluster) (string, error) {
-	lbConfPath, err := cluster.generateConfigFromTemplate("app/files/haproxy.cfg.tpl", "haproxy.cfg")
+	if err := cluster.LB.setDefaults(); err != nil {
+		return "", err
+	}
+	lb := cluster.LoadBalancer()
+	if lb == nil {
+		return "", ErrLBMode
+	}
+	lbConfPath, err := renderTemplate(lb.Template(), lbConfigFileName(lb), cluster.lbModel())
 	if err != nil {
 		Logger.Error("unable to generate lb config file", err, "cluster", cluster.Name)
 		return "", err
@@ -77,10 +111,100 @@ func GenerateConfigCloudInit(cluster *Cluster) (string, error) {
 		return "", ErrBase64Encode
 	}
 	bootstrapConfig.NodeBootstrapScript = encodedBootstrapScript
-	cloudInitPath, err := bootstrapConfig.updateCloudinit()
+	if cluster.Storage != "" {
+		// the nodes mount the NFS volumes
+		bootstrapConfig.Packages = append(bootstrapConfig.Packages, "nfs-common")
+	}
+	bootstrapConfig.SSHAuthorizedKeys = cluster.sshAuthorizedKeys()
+	// the proxy must be set before cloud init updates the packages
+	bootstrapConfig.Files = append(bootstrapConfig.Files, cluster.proxyFiles()...)
+	if err := bootstrapConfig.addCACerts(cluster.CACerts); err != nil {
+		return "", err
+	}
+	if cluster.ArtifactsURL != "" {
+		cacheDir, err := ArtifactCacheDir(cluster.ArtifactsVersion)
+		if err != nil {
+			return "", err
+		}
+		env := fmt.Sprintf("ARTIFACTS_URL=%s\nKUBE_VERSION=%s\nSANDBOX_IMAGE=%s\nEXTRA_PACKAGES=\"%s\"\n",
+			cluster.ArtifactsURL, cluster.ArtifactsVersion, sandboxImage(cacheDir),
+			strings.Join(bootstrapConfig.Packages, " "))
+		bootstrapConfig.Files = append(bootstrapConfig.Files, BootstrapFile{
+			Path:    artifactsEnvPath,
+			Content: base64.StdEncoding.EncodeToString([]byte(env)),
+		})
+		// cloud init cannot reach the apt repositories, install.sh installs the packages
+		bootstrapConfig.Packages = nil
+		bootstrapConfig.Offline = true
+	}
+	// containerd reads the mirrors of a registry from /etc/containerd/certs.d/<registry>/hosts.toml
+	for _, hosts := range cluster.mirrorHosts() {
+		outFileName := cluster.Name + "-hosts-" + hosts.Registry + ".toml"
+		hostsPath, err := renderTemplate("app/files/registry-mirror-hosts.toml.tpl", outFileName, hosts)
+		if err != nil {
+			Logger.Error("unable to generate registry mirror config", "err", err, "registry", hosts.Registry)
+			return "", ErrCloudInitGeneration
+		}
+		content, err := EncodeFileB64(hostsPath)
+		if err != nil {
+			return "", ErrBase64Encode
+		}
+		bootstrapConfig.Files = append(bootstrapConfig.Files, BootstrapFile{
+			Path:    "/etc/containerd/certs.d/" + hosts.Registry + "/hosts.toml",
+			Content: content,
+		})
+	}
+	cloudInitPath, err := bootstrapConfig.updateCloudinit("cloudinit.yaml")
 	if err != nil {
 		Logger.Error("unable to encode file", err, "filename", "install.sh")
 		return "", ErrCloudInitGeneration
 	}
+	// the fragments of all the VMs go in the shared file, the control nodes and the worker pools get a copy with their
+	// own fragments
+	if len(cluster.CloudInit.All) > 0 {
+		if err := mergeCloudInitFile(cloudInitPath, cluster.CloudInit.All, cloudInitPath); err != nil {
+			return "", err
+		}
+	}
+	for _, pool := range append([]string{ControlPool}, cluster.WorkerPoolNames()...) {
+		if fragments := cluster.CloudInit.pool(pool); len(fragments) > 0 {
+			if err := mergeCloudInitFile(cloudInitPath, fragments, cluster.poolCloudInit(cloudInitPath, pool)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return cloudInitPath, nil
+}
+
+// addCACerts adds the certificates of the PEM bundles of the host at paths to the certificates trusted by the VMs.
+func (config *BootstrapConfig) addCACerts(paths []string) error {
+	certs, err := loadCACerts(paths)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		config.CACerts = append(config.CACerts, "      "+strings.ReplaceAll(cert, "\n", "\n      "))
+	}
+	return nil
+}
+
+// GenerateConfigCloudInitSupport generates the cloud init file of the VMs which serve the cluster without joining it,
+// the storage and registry VMs: the users, SSH keys, proxy and CA settings of the nodes, without the kubernetes
+// bootstrap script and the cloud config fragments of the nodes. Returns the path of the file.
+func GenerateConfigCloudInitSupport(cluster *Cluster) (string, error) {
+	bootstrapConfig := BootstrapConfig{
+		SSHAuthorizedKeys: cluster.sshAuthorizedKeys(),
+		Files:             cluster.proxyFiles(),
+		// the apt repositories are not reachable offline
+		Offline: cluster.ArtifactsURL != "",
+	}
+	if err := bootstrapConfig.addCACerts(cluster.CACerts); err != nil {
+		return "", err
+	}
+	cloudInitPath, err := bootstrapConfig.updateCloudinit(supportCloudInitFileName)
+	if err != nil {
+		Logger.Error("unable to generate the support vms cloud init file", "err", err, "cluster", cluster.Name)
+		return "", ErrCloudInitGeneration
+	}
 	return cloudInitPath, nil
 }
@@ -0,0 +1,379 @@
+package app
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// cloudConfigHeader is the first line of a cloud config file, without it cloud init ignores the file.
+const cloudConfigHeader = "#cloud-config"
+
+// cloudConfigKey matches the line of a YAML key and its inline value, eg: package_update: true.
+var cloudConfigKey = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#"'\-][^:#]*):(?:\s+(.*))?$`)
+
+// cloudInitSchemaWarning warns once that the host has no cloud-init to check the schema of the cloud init files.
+var cloudInitSchemaWarning sync.Once
+
+// CloudInitFragments are cloud config files of the host merged into the cloud init file generated by kmpass, eg: to
+// install extra packages, set sysctls or run agents on the nodes.
+type CloudInitFragments struct {
+	// All are merged into the cloud init file of every VM of the cluster.
+	All []string
+	// Control and Worker are merged into the cloud init file of the control nodes and of all the workers, after All.
+	Control []string
+	Worker  []string
+	// Pools are merged into the cloud init file of the nodes of a worker pool, by pool name, after Worker, eg: cmp
+	// for the default pool, small or big.
+	Pools map[string][]string
+}
+
+// pool returns the fragments of the control nodes or of a worker pool, without the fragments of all the VMs.
+func (fragments CloudInitFragments) pool(pool string) []string {
+	if pool == ControlPool {
+		return fragments.Control
+	}
+	return append(append([]string{}, fragments.Worker...), fragments.Pools[pool]...)
+}
+
+// validate checks the fragments are readable cloud config files, and the pools of the fragments are worker pools
+// of the cluster.
+func (fragments CloudInitFragments) validate(pools []string) error {
+	paths := [][]string{fragments.All, fragments.Control, fragments.Worker}
+	for pool, poolPaths := range fragments.Pools {
+		if !slices.Contains(pools, pool) {
+			Logger.Error("cloud init fragments of an unknown worker pool", "pool", pool)
+			return ErrNodePool
+		}
+		paths = append(paths, poolPaths)
+	}
+	for _, paths := range paths {
+		for _, path := range paths {
+			if _, err := readCloudConfig(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cloudConfigBlock is a top level key of a cloud config file with its value, as the lines of the file.
+type cloudConfigBlock struct {
+	Key   string
+	Lines []string
+}
+
+// inline returns the value of the block written on the line of its key, empty for a list or a mapping.
+func (block cloudConfigBlock) inline() string {
+	value := cloudConfigKey.FindStringSubmatch(block.Lines[0])[2]
+	if strings.HasPrefix(value, "#") {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// kind returns whether the value of the block is a list, a mapping or a scalar. Block scalars, eg: key: |, are
+// scalars. Flow collections, eg: key: [a, b], must be expanded first.
+func (block cloudConfigBlock) kind() string {
+	if block.inline() != "" {
+		return "scalar"
+	}
+	for _, line := range block.Lines[1:] {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			return "list"
+		}
+		return "mapping"
+	}
+	return "scalar"
+}
+
+// expand writes a flow collection written on the line of its key, eg: key: [a, b], as a block collection, and returns
+// the kind of the value. A flow collection on several lines is a scalar, it cannot be merged.
+func (block cloudConfigBlock) expand() (cloudConfigBlock, string) {
+	value := block.inline()
+	if !strings.HasPrefix(value, "[") && !strings.HasPrefix(value, "{") {
+		return block, block.kind()
+	}
+	items, ok := flowItems(value)
+	if !ok || block.kind() != "scalar" || indentation(block.Lines[1:]) > 0 {
+		return block, "scalar"
+	}
+	key := cloudConfigKey.FindStringSubmatch(block.Lines[0])[1]
+	lines := []string{key + ":"}
+	for _, item := range items {
+		if value[0] == '[' {
+			item = "- " + item
+		}
+		lines = append(lines, "  "+item)
+	}
+	if value[0] == '[' {
+		return cloudConfigBlock{Key: block.Key, Lines: lines}, "list"
+	}
+	return cloudConfigBlock{Key: block.Key, Lines: lines}, "mapping"
+}
+
+// flowItems splits a flow collection, eg: [a, [b, c]], into its items. ok is false when the collection is not closed
+// on the line.
+func flowItems(value string) ([]string, bool) {
+	var items []string
+	depth, start := 0, 1
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				rest := strings.TrimSpace(value[i+1:])
+				if rest != "" && !strings.HasPrefix(rest, "#") {
+					return nil, false
+				}
+				if item := strings.TrimSpace(value[start:i]); item != "" {
+					items = append(items, item)
+				}
+				return items, true
+			}
+		case c == ',' && depth == 1:
+			items = append(items, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return nil, false
+}
+
+// parseCloudConfig splits a cloud config document into its top level blocks. The lines before the first key, the
+// header and comments, are returned apart.
+func parseCloudConfig(content string) ([]string, []cloudConfigBlock, error) {
+	var preamble []string
+	var blocks []cloudConfigBlock
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "...") || strings.HasPrefix(line, "\t") {
+			return nil, nil, ErrCloudInitFragment
+		}
+		if match := cloudConfigKey.FindStringSubmatch(line); match != nil {
+			blocks = append(blocks, cloudConfigBlock{Key: strings.Trim(match[1], `"'`), Lines: []string{line}})
+			continue
+		}
+		// a list at the indentation of its key is valid YAML, eg: the write_files items
+		nested := line == "" || line[0] == ' ' || line[0] == '#' || line[0] == '-'
+		switch {
+		case !nested:
+			return nil, nil, ErrCloudInitFragment
+		case len(blocks) == 0 && strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#"):
+			return nil, nil, ErrCloudInitFragment
+		case len(blocks) == 0:
+			preamble = append(preamble, line)
+		default:
+			blocks[len(blocks)-1].Lines = append(blocks[len(blocks)-1].Lines, line)
+		}
+	}
+	return preamble, blocks, nil
+}
+
+// indentation returns the indentation of the lines, comments and blank lines aside.
+func indentation(lines []string) int {
+	indent := -1
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	return max(indent, 0)
+}
+
+// reindent moves lines indented by from to the indentation to.
+func reindent(lines []string, from int, to int) []string {
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" {
+			out = append(out, "")
+			continue
+		}
+		extra := max(len(line)-len(trimmed)-from, 0)
+		out = append(out, strings.Repeat(" ", to+extra)+trimmed)
+	}
+	return out
+}
+
+// mergeCloudConfigBlocks merges the blocks of a fragment into base, the way cloud init merges the parts of a
+// multi-part user data with list(append)+dict(recurse_array): lists are appended, mappings are merged key by key and
+// the scalars of the fragment replace the scalars of base. A fragment which would replace a list or a mapping of base,
+// eg: the runcmd of kmpass, is rejected.
+func mergeCloudConfigBlocks(base []cloudConfigBlock, fragment []cloudConfigBlock) ([]cloudConfigBlock, error) {
+	merged := append([]cloudConfigBlock{}, base...)
+	for _, block := range fragment {
+		i := -1
+		for j := range merged {
+			if merged[j].Key == block.Key {
+				i = j
+			}
+		}
+		if i < 0 {
+			merged = append(merged, block)
+			continue
+		}
+		var baseKind, kind string
+		merged[i], baseKind = merged[i].expand()
+		block, kind = block.expand()
+		switch {
+		case baseKind == "scalar":
+			merged[i] = block
+		case kind == "scalar":
+			Logger.Error("cloud config fragment replaces a list or a mapping", "key", block.Key)
+			return nil, ErrCloudInitFragment
+		case kind != baseKind:
+			Logger.Error("cloud config key has different types", "key", block.Key)
+			return nil, ErrCloudInitFragment
+		case kind == "list":
+			// list items must have the same indentation
+			baseIndent := indentation(merged[i].Lines[1:])
+			lines := append(append([]string{}, merged[i].Lines...),
+				reindent(block.Lines[1:], indentation(block.Lines[1:]), baseIndent)...)
+			merged[i] = cloudConfigBlock{Key: block.Key, Lines: lines}
+		default:
+			baseIndent := indentation(merged[i].Lines[1:])
+			_, baseChildren, err := parseCloudConfig(strings.Join(reindent(merged[i].Lines[1:], baseIndent, 0), "\n"))
+			if err != nil {
+				return nil, err
+			}
+			_, children, err := parseCloudConfig(strings.Join(reindent(block.Lines[1:], indentation(block.Lines[1:]), 0), "\n"))
+			if err != nil {
+				return nil, err
+			}
+			mergedChildren, err := mergeCloudConfigBlocks(baseChildren, children)
+			if err != nil {
+				return nil, err
+			}
+			lines := []string{merged[i].Lines[0]}
+			for _, child := range mergedChildren {
+				lines = append(lines, reindent(child.Lines, 0, baseIndent)...)
+			}
+			merged[i] = cloudConfigBlock{Key: block.Key, Lines: lines}
+		}
+	}
+	return merged, nil
+}
+
+// mergeCloudConfig merges cloud config fragments, in order, into a cloud config document.
+func mergeCloudConfig(base string, fragments ...string) (string, error) {
+	preamble, blocks, err := parseCloudConfig(base)
+	if err != nil {
+		return "", err
+	}
+	for _, fragment := range fragments {
+		_, fragmentBlocks, err := parseCloudConfig(fragment)
+		if err != nil {
+			return "", err
+		}
+		if blocks, err = mergeCloudConfigBlocks(blocks, fragmentBlocks); err != nil {
+			return "", err
+		}
+	}
+	lines := preamble
+	for _, block := range blocks {
+		lines = append(lines, block.Lines...)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// readCloudConfig reads a cloud config fragment of the host and checks it can be merged.
+func readCloudConfig(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		Logger.Error("unable to read cloud init fragment", "err", err, "path", path)
+		return "", ErrCloudInitFragment
+	}
+	if !strings.HasPrefix(string(content), cloudConfigHeader) {
+		Logger.Error("cloud init fragment should start with "+cloudConfigHeader, "path", path)
+		return "", ErrCloudInitFragment
+	}
+	if _, _, err := parseCloudConfig(string(content)); err != nil {
+		Logger.Error("unable to parse cloud init fragment", "err", err, "path", path)
+		return "", err
+	}
+	return string(content), nil
+}
+
+// mergeCloudInitFile merges the fragments into the cloud init file at basePath, and writes the result to outPath.
+func mergeCloudInitFile(basePath string, fragments []string, outPath string) error {
+	base, err := os.ReadFile(basePath)
+	if err != nil {
+		Logger.Error("unable to read cloud init file", "err", err, "path", basePath)
+		return ErrCloudInitGeneration
+	}
+	contents := make([]string, 0, len(fragments))
+	for _, path := range fragments {
+		content, err := readCloudConfig(path)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, content)
+	}
+	merged, err := mergeCloudConfig(string(base), contents...)
+	if err != nil {
+		Logger.Error("unable to merge cloud init fragments", "err", err, "path", basePath)
+		return err
+	}
+	if err := os.WriteFile(outPath, []byte(merged), 0640); err != nil {
+		Logger.Error("unable to write cloud init file", "err", err, "path", outPath)
+		return ErrCreateFile
+	}
+	return nil
+}
+
+// poolCloudInit returns the cloud init file of the control nodes or of a worker pool: the file of all the VMs, merged
+// with the fragments of the pool if it has some.
+func (cluster *Cluster) poolCloudInit(cloudInitPath string, pool string) string {
+	if len(cluster.CloudInit.pool(pool)) == 0 {
+		return cloudInitPath
+	}
+	return filepath.Join(filepath.Dir(cloudInitPath), "cloudinit-"+pool+".yaml")
+}
+
+// validateCloudInit checks a cloud init file before multipass passes it to the VM, where an invalid file is only
+// reported in the cloud init logs. The schema is checked with the cloud-init of the host, if installed.
+func validateCloudInit(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		Logger.Error("unable to read cloud init file", "err", err, "path", path)
+		return ErrCloudInitSchema
+	}
+	if !strings.HasPrefix(string(content), cloudConfigHeader) {
+		return ErrCloudInitSchema
+	}
+	if _, _, err := parseCloudConfig(string(content)); err != nil {
+		return ErrCloudInitSchema
+	}
+	if _, err := exec.LookPath("cloud-init"); err != nil {
+		cloudInitSchemaWarning.Do(func() {
+			Logger.Warn("cloud-init not found on the host, the cloud init schema is not checked")
+		})
+		return nil
+	}
+	if out, err := exec.Command("cloud-init", "schema", "--config-file", path).CombinedOutput(); err != nil {
+		Logger.Error("invalid cloud init file", "err", err, "output", string(out), "path", path)
+		return ErrCloudInitSchema
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMergeCloudConfig(t *testing.T) {
+	base := `#cloud-config
+users:
+  - default
+package_update: true
+packages:
+  - nfs-common
+write_files:
+- path: /tmp/install.sh
+  content: abc
+runcmd:
+ - [ sudo, /tmp/install.sh ]
+`
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "append_lists",
+			fragment: "#cloud-config\npackages:\n- bpftrace\nruncmd:\n    - [ systemctl, start, agent ]\n",
+			want: `#cloud-config
+users:
+  - default
+package_update: true
+packages:
+  - nfs-common
+  - bpftrace
+write_files:
+- path: /tmp/install.sh
+  content: abc
+runcmd:
+ - [ sudo, /tmp/install.sh ]
+ - [ systemctl, start, agent ]
+`,
+		},
+		{
+			name:     "replace_scalar_and_add_key",
+			fragment: "#cloud-config\npackage_update: false\ntimezone: Europe/Paris\n",
+			want: `#cloud-config
+users:
+  - default
+package_update: false
+packages:
+  - nfs-common
+write_files:
+- path: /tmp/install.sh
+  content: abc
+runcmd:
+ - [ sudo, /tmp/install.sh ]
+timezone: Europe/Paris
+`,
+		},
+		{
+			name:     "list_and_mapping",
+			fragment: "#cloud-config\npackages:\n  upgrade: true\n",
+			wantErr:  true,
+		},
+		{
+			name:     "append_flow_lists",
+			fragment: "#cloud-config\npackages: [bpftrace, \"a, b\"]\nruncmd: [[sysctl, -p]] # reload\n",
+			want: `#cloud-config
+users:
+  - default
+package_update: true
+packages:
+  - nfs-common
+  - bpftrace
+  - "a, b"
+write_files:
+- path: /tmp/install.sh
+  content: abc
+runcmd:
+ - [ sudo, /tmp/install.sh ]
+ - [sysctl, -p]
+`,
+		},
+		{name: "replace_list", fragment: "#cloud-config\nruncmd: |\n  sysctl -p\n", wantErr: true},
+		{name: "multiline_flow_list", fragment: "#cloud-config\npackages: [bpftrace,\n  jq]\n", wantErr: true},
+		{name: "document_separator", fragment: "#cloud-config\n---\nruncmd: []\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeCloudConfig(base, tt.fragment)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeCloudConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("mergeCloudConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeCloudConfig_mappings(t *testing.T) {
+	base := "#cloud-config\napt:\n  preserve_sources_list: true\n  sources:\n    docker:\n      source: deb x\n"
+	fragment := "#cloud-config\napt:\n    sources:\n        agent:\n            source: deb y\n"
+	want := "#cloud-config\napt:\n  preserve_sources_list: true\n  sources:\n    docker:\n      source: deb x\n" +
+		"    agent:\n        source: deb y\n"
+	got, err := mergeCloudConfig(base, fragment)
+	if err != nil {
+		t.Fatalf("mergeCloudConfig() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("mergeCloudConfig() = %q, want %q", got, want)
+	}
+}
+
+func TestMergeCloudConfig_flowMapping(t *testing.T) {
+	base := "#cloud-config\napt:\n  preserve_sources_list: true\n"
+	fragment := "#cloud-config\napt: {conf: 'APT::Retries \"3\";'}\n"
+	want := "#cloud-config\napt:\n  preserve_sources_list: true\n  conf: 'APT::Retries \"3\";'\n"
+	got, err := mergeCloudConfig(base, fragment)
+	if err != nil {
+		t.Fatalf("mergeCloudConfig() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("mergeCloudConfig() = %q, want %q", got, want)
+	}
+}
+
+func TestReadCloudConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	noHeader := filepath.Join(dir, "no-header.yaml")
+	if err := os.WriteFile(valid, []byte("#cloud-config\npackages: [bpftrace]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(noHeader, []byte("packages: [bpftrace]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "valid", path: valid},
+		{name: "no_header", path: noHeader, wantErr: true},
+		{name: "missing", path: filepath.Join(dir, "missing.yaml"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readCloudConfig(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("readCloudConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloudInitFragments_pool(t *testing.T) {
+	fragments := CloudInitFragments{
+		Control: []string{"control.yaml"},
+		Worker:  []string{"worker.yaml"},
+		Pools:   map[string][]string{"big": {"big.yaml"}},
+	}
+	tests := []struct {
+		pool string
+		want []string
+	}{
+		{pool: ControlPool, want: []string{"control.yaml"}},
+		{pool: defaultWorkerPool, want: []string{"worker.yaml"}},
+		{pool: "big", want: []string{"worker.yaml", "big.yaml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			if got := fragments.pool(tt.pool); !slices.Equal(got, tt.want) {
+				t.Errorf("pool() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if err := fragments.validate([]string{defaultWorkerPool, "small"}); !errors.Is(err, ErrNodePool) {
+		t.Errorf("validate() error = %v, want %v", err, ErrNodePool)
+	}
+}
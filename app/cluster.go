@@ -1,11 +1,13 @@
 package app
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"text/template"
 )
@@ -30,23 +32,99 @@ type Cluster struct {
 	CmpNodesCores    int
 	CmpNodesNumber   int
 	CmpNodesDiskSize string
+	// CmpNodesLabels and CmpNodesTaints are set on the compute nodes when they join, eg: {"disk": "ssd"}.
+	CmpNodesLabels map[string]string
+	CmpNodesTaints []NodeTaint
 	// List of IPs for the control node. Minimum 3.
 	CtrlNodesIPs      []string
 	CtrlNodesMemory   string
 	CtrlNodesCores    int
 	CtrlNodesNumber   int
 	CtrlNodesDiskSize string
-	LBNodeMemory      string
-	LBNodeCore        int
-	LBNodeDiskSize    string
+	// CtrlNodesLabels and CtrlNodesTaints are set on the control nodes when they join. The control nodes keep the
+	// kubeadm control-plane taint.
+	CtrlNodesLabels map[string]string
+	CtrlNodesTaints []NodeTaint
+	// WorkerPools are named groups of worker nodes, next to the default pool of the CmpNodes fields, which can be
+	// empty. Their nodes are named <cluster>-<pool>-N.
+	WorkerPools []NodePool
+	// WorkerPoolsIPs are the IPs of the worker nodes by pool, the default pool is cmp. CmpNodesIPs holds all of them.
+	WorkerPoolsIPs map[string][]string
+	LBNodeMemory   string
+	LBNodeCore     int
+	LBNodeDiskSize string
+	// List of IPs for the load balancer nodes, in LB name order.
+	LBNodesIPs []string
+	// LBHighAvailability deploys a pair of LB nodes sharing VirtualIP with keepalived instead of a single LB node.
+	LBHighAvailability bool
+	// VirtualIP is the keepalived virtual IP of the LB pair, taken from the multipass subnet. It is chosen
+	// automatically at LB creation if empty.
+	VirtualIP string
+	// LB holds the load balancer listeners settings.
+	LB LBConfig
+	// LBMode selects how the kube API is load balanced: haproxy (default), nginx or Envoy on dedicated LB VMs, or
+	// kube-vip static pods on the control nodes advertising VirtualIP.
+	LBMode string
 	// OS image
 	Image string
-	Mux   sync.Mutex
+	Mux   sync.Mutex `json:"-"`
 	// Bootstrap Tokens take the form of abcdef.0123456789abcdef.
 	// More formally, they must match the regular expression [a-z0-9]{6}\.[a-z0-9]{16}.
 	// They can also be created using the command kubeadm token create.
 	BootstrapToken    string
 	KubernetesCertKey string
+	// KubernetesVersion is the version the cluster was last upgraded to. Empty if it was never upgraded, in which
+	// case it runs the version pinned in the node bootstrap script.
+	KubernetesVersion string
+	// Snapshots taken with the snapshot command, oldest first.
+	Snapshots []SnapshotInfo
+	// KubeProxyReplacement installs Cilium as the kube-proxy replacement at the creation, kube-proxy is not deployed.
+	// It cannot be changed afterwards. The Cilium LB-IPAM and ingress controller need it.
+	KubeProxyReplacement bool
+	// ServiceLBProvider is cilium or metallb once the LoadBalancer services support is installed.
+	ServiceLBProvider string
+	// ServiceLBRange is the address range of the LoadBalancer services in the multipass subnet, eg:
+	// 10.1.1.230-10.1.1.244. Chosen automatically if empty.
+	ServiceLBRange string
+	// Ingress is the ingress controller deployed on the workers, nginx or cilium. Empty if none.
+	Ingress string
+	// Storage exports an NFS directory, used by the default StorageClass, from the first LB node (lb) or from a
+	// dedicated VM (vm). No StorageClass if empty.
+	Storage string
+	// StorageDiskSize is the disk size of the dedicated storage VM.
+	StorageDiskSize string
+	// StorageIP is the address of the NFS server, set once the storage is installed.
+	StorageIP string
+	// Registry runs a local container registry, trusted by the nodes, on the first LB node (lb) or on a dedicated VM
+	// (vm). No registry if empty.
+	Registry string
+	// RegistryIP is the address of the registry VM, set once the registry is installed.
+	RegistryIP string
+	// RegistryPassword is the password of the registry user, generated per cluster.
+	RegistryPassword string
+	// RegistryMirrors are pulled from before the upstream registries, configured on the nodes by cloud init.
+	RegistryMirrors []RegistryMirror
+	// Proxy is the HTTP proxy the VMs reach the internet through. No proxy if empty.
+	Proxy ProxyConfig
+	// CACerts are PEM bundles of the host trusted by the VMs, eg: the root CA of a TLS intercepting proxy.
+	CACerts []string
+	// SSHAuthorizedKeys are the public keys authorized on the ubuntu user of the VMs. The keys of the user,
+	// ~/.ssh/id_*.pub, if empty.
+	SSHAuthorizedKeys []string
+	// CloudInit are cloud config fragments of the host merged into the cloud init file of the VMs.
+	CloudInit CloudInitFragments
+	// ArtifactsURL is the host artifact server the nodes are installed from in offline mode, eg:
+	// http://10.1.1.1:8775. Empty if the nodes are installed from the internet.
+	ArtifactsURL string
+	// ArtifactsVersion is the kubernetes version of the artifact cache served in offline mode, eg: 1.25.5.
+	ArtifactsVersion string
+	// PullCache runs a pull-through cache of the common registries on the first LB node, so that images are
+	// downloaded once per cluster instead of once per node.
+	PullCache bool
+	// Addons are enabled at the end of the cluster creation, eg: metrics-server.
+	Addons []string
+	// InstalledAddons are the addons enabled on the cluster, in install order.
+	InstalledAddons []string
 }
 
 // ValidateConfig checks if cluster configuration is valid.
@@ -67,13 +145,16 @@ func (cluster *Cluster) ValidateConfig() error {
 		Logger.Debug("a cluster requires at least 3 control nodes", "ctrl-nodes-num", cluster.CtrlNodesNumber)
 		return ErrMinControlNodes
 	}
-	if cluster.CmpNodesNumber%2 == 0 {
+	if cluster.CtrlNodesNumber%2 == 0 {
 		Logger.Debug("an ood number of control nodes is required", "ctrl-nodes-num", cluster.CtrlNodesNumber)
 		return ErrOddNumberCtrlNode
 	}
 	// validate worker nodes number
-	if cluster.CmpNodesCores < minCmpNodes {
-		Logger.Debug("a cluster requires at least 1 worker nodes", "worker-nodes-num", cluster.CmpNodesNumber)
+	if err := cluster.validateWorkerPools(); err != nil {
+		return err
+	}
+	if cluster.workerNodesNumber() < minCmpNodes {
+		Logger.Debug("a cluster requires at least 1 worker nodes", "worker-nodes-num", cluster.workerNodesNumber())
 		return ErrMinComputeNodes
 	}
 	// validate cluster Pod subnet format
@@ -81,12 +162,112 @@ func (cluster *Cluster) ValidateConfig() error {
 		Logger.Debug("cluster Pod subnet address is invalid", "cluster-ip", cluster.PodSubnet)
 		return ErrInvalidIPV4Address
 	}
+	for _, labels := range []map[string]string{cluster.CtrlNodesLabels, cluster.CmpNodesLabels} {
+		if err := validateNodeLabels(labels); err != nil {
+			return err
+		}
+	}
+	for _, taints := range [][]NodeTaint{cluster.CtrlNodesTaints, cluster.CmpNodesTaints} {
+		if err := validateNodeTaints(taints); err != nil {
+			return err
+		}
+	}
+	if err := cluster.LB.validate(cluster.lbPools()); err != nil {
+		Logger.Debug("invalid load balancer settings", "cluster", cluster.Name, "err", err)
+		return err
+	}
+	if cluster.LBMode != "" && !slices.Contains(lbModes, cluster.LBMode) {
+		Logger.Debug("invalid load balancer mode", "cluster", cluster.Name, "lb-mode", cluster.LBMode)
+		return ErrLBMode
+	}
+	if cluster.LBMode == LBModeKubeVIP && cluster.LBHighAvailability {
+		Logger.Debug("kube-vip mode does not use LB nodes, they cannot be highly available", "cluster", cluster.Name)
+		return ErrLBMode
+	}
+	// validate the LB virtual IP, if set
+	if cluster.VirtualIP != "" && net.ParseIP(cluster.VirtualIP).To4() == nil {
+		Logger.Debug("LB virtual IP address is invalid", "virtual-ip", cluster.VirtualIP)
+		return ErrInvalidIPV4Address
+	}
+	if cluster.Ingress != "" && cluster.Ingress != IngressNginx && cluster.Ingress != IngressCilium {
+		Logger.Debug("invalid ingress controller", "cluster", cluster.Name, "ingress", cluster.Ingress)
+		return ErrIngressController
+	}
+	if cluster.Ingress == IngressCilium && !cluster.KubeProxyReplacement {
+		Logger.Debug("cilium ingress needs the kube-proxy replacement", "cluster", cluster.Name)
+		return ErrKubeProxyReplacement
+	}
+	if cluster.Storage != "" && cluster.Storage != StorageLB && cluster.Storage != StorageVM {
+		return ErrStorage
+	}
+	if cluster.Storage == StorageLB && cluster.LBMode == LBModeKubeVIP {
+		return ErrStorage
+	}
+	if cluster.StorageDiskSize != "" && !validateMemoryFormat(cluster.StorageDiskSize) {
+		return ErrMemFormat
+	}
+	if cluster.Registry != "" && cluster.Registry != RegistryLB && cluster.Registry != RegistryVM {
+		return ErrRegistry
+	}
+	if cluster.Registry == RegistryLB {
+		if cluster.LBMode == LBModeKubeVIP {
+			return ErrRegistry
+		}
+		if cluster.lbPortUsed(registryPort) {
+			Logger.Debug("the registry port is used by the load balancer", "port", registryPort)
+			return ErrLBPortCollision
+		}
+	}
+	if err := cluster.Proxy.validate(); err != nil {
+		Logger.Debug("invalid proxy", "cluster", cluster.Name)
+		return err
+	}
+	if _, err := loadCACerts(cluster.CACerts); err != nil {
+		return err
+	}
+	if err := validateSSHKeys(cluster.SSHAuthorizedKeys); err != nil {
+		Logger.Debug("invalid SSH authorized keys", "cluster", cluster.Name)
+		return err
+	}
+	if err := cluster.CloudInit.validate(cluster.WorkerPoolNames()); err != nil {
+		Logger.Debug("invalid cloud init fragments", "cluster", cluster.Name)
+		return err
+	}
+	if err := validateRegistryMirrors(cluster.RegistryMirrors); err != nil {
+		Logger.Debug("invalid registry mirrors", "cluster", cluster.Name)
+		return err
+	}
+	if cluster.PullCache {
+		if cluster.LBMode == LBModeKubeVIP {
+			return ErrPullCache
+		}
+		for _, upstream := range pullCacheUpstreams {
+			if cluster.lbPortUsed(upstream.Port) {
+				Logger.Debug("the pull-through cache port is used by the load balancer", "port", upstream.Port)
+				return ErrLBPortCollision
+			}
+		}
+	}
+	if _, err := resolveAddons(addonRegistry, cluster.Addons); err != nil {
+		return err
+	}
+	if cluster.ServiceLBRange != "" {
+		if _, _, err := parseIPRange(cluster.ServiceLBRange); err != nil {
+			Logger.Debug("service LB range is invalid", "range", cluster.ServiceLBRange)
+			return err
+		}
+	}
 	return nil
 }
 
 // generateConfigFromTemplate configuration files from templates. Will be used to generate LB and kubernetes
 // configurations.
 func (cluster *Cluster) generateConfigFromTemplate(templatePath string, outFileName string) (string, error) {
+	return renderTemplate(templatePath, outFileName, cluster)
+}
+
+// renderTemplate renders a template with the given data in the kmpass directory. Returns the path of the rendered file.
+func renderTemplate(templatePath string, outFileName string, data any) (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		Logger.Error("unable to read user home directory", err)
@@ -107,64 +288,164 @@ func (cluster *Cluster) generateConfigFromTemplate(templatePath string, outFileN
 		Logger.Error("unable to create temp file", err)
 		return filePath, ErrCreateFile
 	}
-	if err := parsedTpl.Execute(file, cluster); err != nil {
+	if err := parsedTpl.Execute(file, data); err != nil {
 		Logger.Error("unable to parse template", err)
 		return filePath, ErrParseTemplate
 	}
 	return filePath, nil
 }
 
+// renderSecretTemplate renders a template holding secrets in the cluster directory, only readable by the user. Returns
+// the path of the rendered file, which the caller removes once used.
+func renderSecretTemplate(templatePath string, clusterName string, outFileName string, data any) (string, error) {
+	parsedTpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		Logger.Error("unable to parse template", "err", err, "template", templatePath)
+		return "", ErrParseTemplate
+	}
+	var content bytes.Buffer
+	if err := parsedTpl.Execute(&content, data); err != nil {
+		Logger.Error("unable to render template", "err", err, "template", templatePath)
+		return "", ErrParseTemplate
+	}
+	dir, err := ClusterDir(clusterName)
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(dir, outFileName)
+	if err := os.WriteFile(filePath, content.Bytes(), 0600); err != nil {
+		Logger.Error("unable to create file", "err", err, "filename", filePath)
+		return "", ErrCreateFile
+	}
+	return filePath, nil
+}
+
 // CreateLB creates the LB associated with the cluster and run it. After running this method, you'll have a LB deployed
 // and ready to server traffic. Returns a pointer to an instance of VM and an error. If the VM already exist, an error
-// will be thrown but the VM instance that will be returned will be valid.
+// will be thrown but the VM instance that will be returned will be valid. When LBHighAvailability is set, a pair of
+// LB VMs is created and keepalived moves the cluster virtual IP between them. The virtual IP is then the cluster
+// public API endpoint.
 func (cluster *Cluster) CreateLB(cloudInitPath string, lbConfPath string) (*Instance, error) {
-	lbName := fmt.Sprintf("%s-lb01", cluster.Name)
+	var firstLB *Instance
+	var existErr error
+	for _, lbName := range cluster.LBNames() {
+		lbVM, IP, err := cluster.createLBVM(lbName, cloudInitPath, lbConfPath)
+		if firstLB == nil {
+			firstLB = lbVM
+		}
+		if errors.Is(err, ErrVMAlreadyExist) {
+			existErr = err
+		} else if err != nil {
+			return firstLB, err
+		}
+		cluster.AddLBIP(IP)
+	}
+	if !cluster.LBHighAvailability {
+		cluster.PublicAPIEndpoint = cluster.LBNodesIPs[0]
+		return firstLB, existErr
+	}
+	if existErr == nil || cluster.VirtualIP == "" {
+		if err := cluster.configureKeepalived(); err != nil {
+			Logger.Error("unable to configure the LB virtual IP", "err", err, "cluster", cluster.Name)
+			return firstLB, err
+		}
+	}
+	cluster.PublicAPIEndpoint = cluster.VirtualIP
+	return firstLB, existErr
+}
+
+// createLBVM creates a LB VM, installs the load balancer with the given configuration and keepalived if needed. Returns the VM
+// and its IP address. If the VM already exist, ErrVMAlreadyExist is returned with a valid VM and IP.
+func (cluster *Cluster) createLBVM(lbName string, cloudInitPath string, lbConfPath string) (*Instance, string, error) {
 	lbVM, err := NewInstanceConfig(cluster.LBNodeCore, cluster.LBNodeMemory, cluster.LBNodeDiskSize, cluster.Image, lbName, cloudInitPath)
 	if err != nil {
-		Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-		return lbVM, err
+		Logger.Error("unable to create LB vm instance", "err", err, "instance-name", lbName)
+		return lbVM, "", err
 	}
 	if !lbVM.Exist() {
 		if err := lbVM.Create(); err != nil {
-			Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-			return lbVM, err
+			Logger.Error("unable to create LB vm instance", "err", err, "instance-name", lbName)
+			return lbVM, "", err
 		}
 	} else {
 		// @TODO: we should eventually start it but let's keep it this way for now
 		Logger.Warn("vm already exist, doing nothing", "instance-name", lbName)
 		IP, err := lbVM.GetIP()
 		if err != nil {
-			Logger.Error("unable to retrieve vm IP address", err, "instance-name", lbName)
-			return lbVM, err
+			Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", lbName)
+			return lbVM, "", err
 		}
-		cluster.PublicAPIEndpoint = IP
-		return lbVM, ErrVMAlreadyExist
+		return lbVM, IP, ErrVMAlreadyExist
 	}
 	// install lb software packages and transfer lb configuration file
-	if _, err := RunCmd(lbName, []string{"sudo", "apt-get", "install", "haproxy", "-y"}); err != nil {
-		Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-		return lbVM, err
+	lb := cluster.LoadBalancer()
+	installScript := lb.InstallScript()
+	if cluster.LBHighAvailability {
+		installScript += " && apt-get install -y keepalived"
+	}
+	if out, err := RunCmd(lbName, []string{"sudo", "sh", "-c", installScript}); err != nil {
+		Logger.Error("unable to create LB vm instance", "err", err, "output", out, "instance-name", lbName)
+		return lbVM, "", err
 	}
-	if err := Transfer(lbName, lbConfPath, "haproxy.cfg"); err != nil {
-		Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-		return lbVM, err
+	if err := Transfer(lbName, lbConfPath, lbConfigFileName(lb)); err != nil {
+		Logger.Error("unable to create LB vm instance", "err", err, "instance-name", lbName)
+		return lbVM, "", err
 	}
-	if _, err := RunCmd(lbName, []string{"sudo", "cp", "/tmp/haproxy.cfg", "/etc/haproxy/haproxy.cfg"}); err != nil {
-		Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-		return lbVM, err
+	if _, err := RunCmd(lbName, []string{"sudo", "cp", "/tmp/" + lbConfigFileName(lb), lb.ConfigPath()}); err != nil {
+		Logger.Error("unable to create LB vm instance", "err", err, "instance-name", lbName)
+		return lbVM, "", err
 	}
-	if _, err := RunCmd(lbName, []string{"sudo", "systemctl", "restart", "haproxy"}); err != nil {
-		Logger.Error("unable to create LB vm instance", err, "instance-name", lbName)
-		return lbVM, err
+	if _, err := RunCmd(lbName, []string{"sudo", "systemctl", "restart", lb.Service()}); err != nil {
+		Logger.Error("unable to create LB vm instance", "err", err, "instance-name", lbName)
+		return lbVM, "", err
 	}
 	Logger.Info("instance created and started with success", "instance-name", lbName)
 	IP, err := lbVM.GetIP()
 	if err != nil {
-		Logger.Error("unable to retrieve vm IP address", err, "instance-name", lbName)
-		return lbVM, err
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", lbName)
+		return lbVM, "", err
+	}
+	return lbVM, IP, nil
+}
+
+// PoolIPs returns the IPs of the nodes of a pool, used as LB listener backends: the control nodes, all the workers or
+// a worker pool.
+func (cluster *Cluster) PoolIPs(pool string) []string {
+	switch pool {
+	case ControlPool:
+		return cluster.CtrlNodesIPs
+	case WorkerPool:
+		return cluster.CmpNodesIPs
+	default:
+		return cluster.WorkerPoolsIPs[pool]
+	}
+}
+
+// LBName returns the name of the first load balancer VM of the cluster.
+func (cluster *Cluster) LBName() string {
+	return fmt.Sprintf("%s-lb01", cluster.Name)
+}
+
+// LBNames returns the names of the load balancer VMs of the cluster. There are two of them when LBHighAvailability
+// is set, and none in kube-vip mode.
+func (cluster *Cluster) LBNames() []string {
+	if cluster.LBMode == LBModeKubeVIP {
+		return nil
+	}
+	if !cluster.LBHighAvailability {
+		return []string{cluster.LBName()}
 	}
-	cluster.PublicAPIEndpoint = IP
-	return lbVM, nil
+	return []string{cluster.LBName(), fmt.Sprintf("%s-lb02", cluster.Name)}
+}
+
+// NodeNames returns the names of the kubernetes VMs of the cluster, control nodes first, then the workers pool by
+// pool.
+func (cluster *Cluster) NodeNames() []string {
+	names := make([]string, 0, cluster.CtrlNodesNumber+cluster.workerNodesNumber())
+	for i := 0; i < cluster.CtrlNodesNumber; i++ {
+		names = append(names, fmt.Sprintf("%s-ctrl-%d", cluster.Name, i))
+	}
+	return append(names, cluster.workerNodeNames()...)
 }
 
 // worker is a helper to create VMs concurrently
@@ -185,10 +466,10 @@ func worker(cluster *Cluster, ch <-chan *Instance, wg *sync.WaitGroup) {
 			Logger.Error("unable to retrieve vm IP address", err, "instance-name", vm.Name)
 			return
 		}
-		if strings.Contains(vm.Name, "ctrl") {
+		if pool := cluster.nodePool(vm.Name); pool == ControlPool {
 			cluster.AddControlIP(IP)
 		} else {
-			cluster.AddComputeIP(IP)
+			cluster.addWorkerIP(pool, IP)
 		}
 	}
 }
@@ -197,6 +478,34 @@ func worker(cluster *Cluster, ch <-chan *Instance, wg *sync.WaitGroup) {
 // This method use the worker concurrency pattern to create and run VMs. Creating a high number of VMs will incur
 // network traffic and hypervisor cpu load, so the number of workers should be planned wisely.
 func (cluster *Cluster) CreateKubeVMs(cloudInitPath string, numWorkers int) {
+	ctrlCloudInitPath := cluster.poolCloudInit(cloudInitPath, ControlPool)
+	var vms []*Instance
+	// control nodes first
+	for i := 0; i < cluster.CtrlNodesNumber; i++ {
+		vmName := fmt.Sprintf("%s-ctrl-%d", cluster.Name, i)
+		vmCfg, err := NewInstanceConfig(cluster.CtrlNodesCores, cluster.CtrlNodesMemory,
+			cluster.CtrlNodesDiskSize, cluster.Image, vmName, ctrlCloudInitPath)
+		if err != nil {
+			Logger.Error("unable to create control vm instance config", err, "instance-name", vmName)
+		}
+		vms = append(vms, vmCfg)
+	}
+	// then the compute nodes, with the size and image of their pool
+	for _, pool := range cluster.workerPools() {
+		for _, vmName := range pool.nodeNames(cluster.Name) {
+			vmCfg, err := NewInstanceConfig(pool.Cores, pool.Memory, pool.DiskSize, pool.Image, vmName,
+				cluster.poolCloudInit(cloudInitPath, pool.Name))
+			if err != nil {
+				Logger.Error("unable to create compute vm instance config", "err", err, "instance-name", vmName)
+			}
+			vms = append(vms, vmCfg)
+		}
+	}
+	cluster.createVMs(vms, numWorkers)
+}
+
+// createVMs creates the kubernetes VMs, numWorkers at a time, and adds their IPs to the cluster.
+func (cluster *Cluster) createVMs(vmConfigs []*Instance, numWorkers int) {
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 	vms := make(chan *Instance, numWorkers)
@@ -205,26 +514,9 @@ func (cluster *Cluster) CreateKubeVMs(cloudInitPath string, numWorkers int) {
 	for i := 0; i < numWorkers; i++ {
 		go worker(cluster, vms, &wg)
 	}
-
-	// fill the vms jobs queue with control nodes
-	for i := 0; i < cluster.CtrlNodesNumber; i++ {
-		vmName := fmt.Sprintf("%s-ctrl-%d", cluster.Name, i)
-		vmCfg, err := NewInstanceConfig(cluster.CtrlNodesCores, cluster.CtrlNodesMemory,
-			cluster.CtrlNodesDiskSize, cluster.Image, vmName, cloudInitPath)
-		if err != nil {
-			Logger.Error("unable to create control vm instance config", err, "instance-name", vmName)
-		}
-		vms <- vmCfg
-	}
-	// fill the vms jobs queue with compute nodes
-	for i := 0; i < cluster.CmpNodesNumber; i++ {
-		vmName := fmt.Sprintf("%s-cmp-%d", cluster.Name, i)
-		vmCfg, err := NewInstanceConfig(cluster.CmpNodesCores, cluster.CmpNodesMemory,
-			cluster.CmpNodesDiskSize, cluster.Image, vmName, cloudInitPath)
-		if err != nil {
-			Logger.Error("unable to create compute vm instance config", err, "instance-name", vmName)
-		}
-		vms <- vmCfg
+	// fill the vms jobs queue
+	for _, vm := range vmConfigs {
+		vms <- vm
 	}
 	close(vms)
 	wg.Wait()
@@ -251,6 +543,15 @@ func (cluster *Cluster) AddComputeIP(IP string) {
 	}
 }
 
+// AddLBIP add the IP address of a newly created load balancer machine to LB nodes IP list.
+func (cluster *Cluster) AddLBIP(IP string) {
+	if !containsIP(cluster.LBNodesIPs, IP) {
+		cluster.Mux.Lock()
+		cluster.LBNodesIPs = append(cluster.LBNodesIPs, IP)
+		cluster.Mux.Unlock()
+	}
+}
+
 // AddControlIP add the IP address of a newly created control machine to control nodes IP list.
 // This is because multipass does not allow to set static IP on a node. So we have to fetch them
 // dynamically and update the cluster configurations.
@@ -271,45 +572,27 @@ func (cluster *Cluster) GetCertHash() (string, error) {
 }
 
 // InstallCNI installs the cluster CNI. For now, only cilium is supported and is directly hardcoded
-// in the tool.
+// in the tool. With KubeProxyReplacement, Cilium handles the services instead of kube-proxy, which kubeadm
+// init did not deploy.
 func (cluster *Cluster) InstallCNI() error {
 	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
-	_, err := RunCmd(firstCtrlName, []string{"cilium", "install"})
+	cmd := []string{"cilium", "install"}
+	if cluster.KubeProxyReplacement {
+		// without kube-proxy, the agents reach the API through the cluster endpoint instead of the kubernetes service
+		cmd = append(cmd, "--set", "kubeProxyReplacement=true", "--set", "k8sServiceHost="+cluster.PublicAPIEndpoint,
+			"--set", "k8sServicePort=6443")
+	}
+	if cluster.ArtifactsURL != "" {
+		// the images of the artifact cache are imported by tag
+		cmd = append(cmd, "--set", "image.useDigest=false", "--set", "operator.image.useDigest=false")
+	}
+	_, err := RunCmd(firstCtrlName, cmd)
 	if err != nil {
 		Logger.Error("unable to install cilium cni", err, "cluster", cluster.Name)
 	}
 	return err
 }
 
-// GetMasterJoinCMD build the master join command to join other master nodes
-func (cluster *Cluster) GetMasterJoinCMD() ([]string, error) {
-	certHash, err := cluster.GetCertHash()
-	if err != nil {
-		Logger.Error("unable to get cluster certificate hash", err, "cluster-name", cluster.Name)
-		return []string{}, err
-	}
-	cmd := []string{"sudo", "kubeadm", "join"}
-	cmd = append(cmd, cluster.PublicAPIEndpoint+":6443")
-	cmd = append(cmd, "--token", cluster.BootstrapToken)
-	cmd = append(cmd, "--discovery-token-ca-cert-hash", certHash)
-	cmd = append(cmd, "--control-plane", "--certificate-key", cluster.KubernetesCertKey)
-	return cmd, nil
-}
-
-// GetWorkerJoinCMD build the master join command to join other master nodes
-func (cluster *Cluster) GetWorkerJoinCMD() ([]string, error) {
-	certHash, err := cluster.GetCertHash()
-	if err != nil {
-		Logger.Error("unable to get cluster certificate hash", err, "cluster-name", cluster.Name)
-		return []string{}, err
-	}
-	cmd := []string{"sudo", "kubeadm", "join"}
-	cmd = append(cmd, cluster.PublicAPIEndpoint+":6443")
-	cmd = append(cmd, "--token", cluster.BootstrapToken)
-	cmd = append(cmd, "--discovery-token-ca-cert-hash", certHash)
-	return cmd, nil
-}
-
 // GetControlVM return a VM instance populated with a control node parameters.
 // This is useful to generate the configuration of an existing vm instance to apply specific instance related
 // methods on them (for instance, file transfer)
@@ -333,6 +616,10 @@ func (cluster *Cluster) GetControlVM(vmName string, cloudInitPath string) (*Inst
 // KubeInit runs kubeadm init cmd from control plane node0
 func (cluster *Cluster) KubeInit(remoteHomeDir string) error {
 	cmd := []string{"sudo", "kubeadm", "init", "--config", "/tmp/cluster.yaml", "--upload-certs"}
+	if cluster.LBMode == LBModeKubeVIP {
+		// the kube-vip manifest is already in the static pods directory
+		cmd = append(cmd, "--ignore-preflight-errors=DirAvailable--etc-kubernetes-manifests")
+	}
 	firstCtrlNodeName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
 	if _, err := RunCmd(firstCtrlNodeName, cmd); err != nil {
 		Logger.Error("kubeadm init command failed", err, "cluster", cluster.Name)
@@ -1,6 +1,8 @@
 package app
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -19,6 +21,9 @@ func TestCluster_ValidateConfig(t *testing.T) {
 		LBNodeMemory      string
 		LBNodeCore        int
 		LBNodeDiskSize    string
+		LBMode            string
+		LBHA              bool
+		Registry          string
 	}
 	tests := []struct {
 		name    string
@@ -102,23 +107,146 @@ func TestCluster_ValidateConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "cluster_good_even_cmp_nodes",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    2,
+				CtrlNodesNumber:   3,
+			},
+			wantErr: false,
+		},
+		{
+			name: "cluster_bad_no_cmp_nodes",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    0,
+				CtrlNodesNumber:   3,
+			},
+			wantErr: true,
+		},
+		{
+			name: "cluster_good_kube_vip",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    1,
+				CtrlNodesNumber:   3,
+				LBMode:            "kube-vip",
+			},
+			wantErr: false,
+		},
+		{
+			name: "cluster_bad_lb_mode",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    1,
+				CtrlNodesNumber:   3,
+				LBMode:            "traefik",
+			},
+			wantErr: true,
+		},
+		{
+			name: "cluster_bad_kube_vip_ha",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    1,
+				CtrlNodesNumber:   3,
+				LBMode:            "kube-vip",
+				LBHA:              true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "cluster_bad_registry_kube_vip",
+			fields: fields{
+				Name:              "cluster100",
+				PodSubnet:         "10.10.10.0/24",
+				CmpNodesMemory:    "4G",
+				CmpNodesCores:     3,
+				CmpNodesDiskSize:  "10G",
+				CtrlNodesMemory:   "2G",
+				CtrlNodesCores:    3,
+				CtrlNodesDiskSize: "20G",
+				LBNodeMemory:      "2G",
+				LBNodeCore:        2,
+				LBNodeDiskSize:    "10G",
+				CmpNodesNumber:    1,
+				CtrlNodesNumber:   3,
+				LBMode:            "kube-vip",
+				Registry:          "lb",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			cluster := &Cluster{
-				Name:              tt.fields.Name,
-				PodSubnet:         tt.fields.PodSubnet,
-				CmpNodesMemory:    tt.fields.CmpNodesMemory,
-				CmpNodesCores:     tt.fields.CmpNodesCores,
-				CmpNodesNumber:    tt.fields.CmpNodesNumber,
-				CmpNodesDiskSize:  tt.fields.CmpNodesDiskSize,
-				CtrlNodesMemory:   tt.fields.CtrlNodesMemory,
-				CtrlNodesCores:    tt.fields.CtrlNodesCores,
-				CtrlNodesNumber:   tt.fields.CtrlNodesNumber,
-				CtrlNodesDiskSize: tt.fields.CtrlNodesDiskSize,
-				LBNodeMemory:      tt.fields.LBNodeMemory,
-				LBNodeCore:        tt.fields.LBNodeCore,
-				LBNodeDiskSize:    tt.fields.LBNodeDiskSize,
+				Name:               tt.fields.Name,
+				PodSubnet:          tt.fields.PodSubnet,
+				CmpNodesMemory:     tt.fields.CmpNodesMemory,
+				CmpNodesCores:      tt.fields.CmpNodesCores,
+				CmpNodesNumber:     tt.fields.CmpNodesNumber,
+				CmpNodesDiskSize:   tt.fields.CmpNodesDiskSize,
+				CtrlNodesMemory:    tt.fields.CtrlNodesMemory,
+				CtrlNodesCores:     tt.fields.CtrlNodesCores,
+				CtrlNodesNumber:    tt.fields.CtrlNodesNumber,
+				CtrlNodesDiskSize:  tt.fields.CtrlNodesDiskSize,
+				LBNodeMemory:       tt.fields.LBNodeMemory,
+				LBNodeCore:         tt.fields.LBNodeCore,
+				LBNodeDiskSize:     tt.fields.LBNodeDiskSize,
+				LBMode:             tt.fields.LBMode,
+				LBHighAvailability: tt.fields.LBHA,
+				Registry:           tt.fields.Registry,
 			}
 			if err := cluster.ValidateConfig(); (err != nil) != tt.wantErr {
 				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
@@ -126,3 +254,29 @@ func TestCluster_ValidateConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderSecretTemplate(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	tplPath := filepath.Join(home, "secret.tpl")
+	if err := os.WriteFile(tplPath, []byte("password = {{.}}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path, err := renderSecretTemplate(tplPath, "app300", "secret.toml", "s3cret")
+	if err != nil {
+		t.Fatalf("renderSecretTemplate() error = %v", err)
+	}
+	if want := filepath.Join(home, "kmpass", "app300", "secret.toml"); path != want {
+		t.Errorf("renderSecretTemplate() = %v, want %v", path, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("renderSecretTemplate() mode = %v, want 0600", info.Mode().Perm())
+	}
+	if content, _ := os.ReadFile(path); string(content) != "password = s3cret\n" {
+		t.Errorf("renderSecretTemplate() content = %q", content)
+	}
+}
@@ -0,0 +1,231 @@
+package app
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// diagnosticItem is a file of the diagnostics bundle produced by running a command in a VM.
+type diagnosticItem struct {
+	File string
+	Cmd  []string
+}
+
+// nodeDiagnostics are collected on every kubernetes node.
+var nodeDiagnostics = []diagnosticItem{
+	{File: "cloud-init-output.log", Cmd: []string{"sudo", "cat", "/var/log/cloud-init-output.log"}},
+	{File: "kubelet.log", Cmd: []string{"sudo", "journalctl", "-u", "kubelet", "--no-pager"}},
+	{File: "containerd.log", Cmd: []string{"sudo", "journalctl", "-u", "containerd", "--no-pager"}},
+	{File: "crictl-ps.txt", Cmd: []string{"sudo", "crictl", "ps", "-a"}},
+	{File: "kubelet-config.yaml", Cmd: []string{"sudo", "cat", "/var/lib/kubelet/config.yaml"}},
+}
+
+// lbDiagnostics returns the diagnostics collected on the LB nodes.
+func lbDiagnostics(lb LoadBalancer) []diagnosticItem {
+	return []diagnosticItem{
+		{File: "cloud-init-output.log", Cmd: []string{"sudo", "cat", "/var/log/cloud-init-output.log"}},
+		{File: lb.Service() + ".log", Cmd: []string{"sudo", "journalctl", "-u", lb.Service(), "--no-pager"}},
+		{File: lbConfigFileName(lb), Cmd: []string{"sudo", "cat", lb.ConfigPath()}},
+		{File: "keepalived.log", Cmd: []string{"sudo", "journalctl", "-u", "keepalived", "--no-pager"}},
+		{File: "ip-addr.txt", Cmd: []string{"ip", "addr", "show"}},
+	}
+}
+
+// clusterDiagnostics are collected once, from the first control node, as they describe the whole cluster.
+var clusterDiagnostics = []diagnosticItem{
+	{File: "kubeadm-init.yaml", Cmd: []string{"sudo", "cat", "/tmp/cluster.yaml"}},
+	{File: "kubeadm-config.yaml", Cmd: []string{"kubectl", "-n", "kube-system", "get", "cm", "kubeadm-config", "-o", "yaml"}},
+	{File: "nodes.txt", Cmd: []string{"kubectl", "get", "nodes", "-o", "wide"}},
+	{File: "pods.txt", Cmd: []string{"kubectl", "get", "pods", "-A", "-o", "wide"}},
+	{File: "all.txt", Cmd: []string{"kubectl", "get", "all", "-A"}},
+	{File: "events.txt", Cmd: []string{"kubectl", "get", "events", "-A", "--sort-by=.lastTimestamp"}},
+}
+
+// hostArtifacts are the files rendered on the host by kmpass and added to the bundle, with the cloud init files of the
+// worker pools.
+var hostArtifacts = []string{"cloudinit.yaml", "cloudinit-control.yaml", supportCloudInitFileName, "haproxy.cfg",
+	"nginx.conf", "envoy.yaml", "cluster.yaml"}
+
+// secretPatterns match secrets which can appear in logs and configuration files.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`\b[a-z0-9]{6}\.[a-z0-9]{16}\b`),
+	regexp.MustCompile(`((?i:certificate-?key)["':= ]+)[a-f0-9]{64}`),
+	regexp.MustCompile(`(\b(?:client-key-data|token|password|BootstrapToken|KubernetesCertKey|StatsPassword)["']?\s*[:=]\s*["']?)[^\s"',]+`),
+	regexp.MustCompile(`(--(?:token|password)[= ])[^\s"',]+`),
+	regexp.MustCompile(`(stats auth [^:\s]+:)\S+`),
+}
+
+// b64WriteFile matches the encoding and content lines of the base64 files of a cloud init file.
+var b64WriteFile = regexp.MustCompile(`(?m)^(\s*)(?:- )?encoding: b64\n(?:.*\n)*?\s*content: ([A-Za-z0-9+/=]+)$`)
+
+// decodeCloudInit decodes the base64 files of a cloud init file, so that their secrets can be redacted, eg: the
+// proxy credentials.
+func decodeCloudInit(content string) string {
+	return b64WriteFile.ReplaceAllStringFunc(content, func(entry string) string {
+		match := b64WriteFile.FindStringSubmatch(entry)
+		decoded, err := base64.StdEncoding.DecodeString(match[2])
+		if err != nil || !utf8.Valid(decoded) {
+			return entry
+		}
+		indent := strings.Repeat(" ", len(match[1])+4)
+		lines := strings.Split(strings.TrimSuffix(string(decoded), "\n"), "\n")
+		entry = strings.Replace(entry, "encoding: b64", "encoding: text", 1)
+		return strings.TrimSuffix(entry, match[2]) + "|\n" + indent + strings.Join(lines, "\n"+indent)
+	})
+}
+
+// redact removes the known secrets of the cluster and anything that looks like a secret from content.
+func redact(content string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			content = strings.ReplaceAll(content, secret, "<redacted>")
+		}
+	}
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() == 0 {
+			content = pattern.ReplaceAllString(content, "<redacted>")
+			continue
+		}
+		content = pattern.ReplaceAllString(content, "${1}<redacted>")
+	}
+	return content
+}
+
+// collectItems runs the diagnostic commands in a VM. The output of a command is kept even if it fails, followed by
+// the error, as a failing command is often what we are looking for.
+func collectItems(vmName string, items []diagnosticItem) map[string]string {
+	files := make(map[string]string, len(items))
+	for _, item := range items {
+		out, err := RunCmd(vmName, item.Cmd)
+		if err != nil {
+			out += fmt.Sprintf("\n# kmpass: command %q failed: %v\n", strings.Join(item.Cmd, " "), err)
+		}
+		files[item.File] = out
+	}
+	return files
+}
+
+// CollectLogs gathers logs, runtime status and configuration files from every VM of the cluster, numWorkers VMs at a
+// time, adds the artifacts rendered on the host and writes everything, with secrets redacted, in a timestamped tar.gz
+// archive. The archive is written in outDir, or in the cluster directory if outDir is empty. Returns the path of the
+// archive.
+func (cluster *Cluster) CollectLogs(outDir string, numWorkers int) (string, error) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	// bundle maps a path in the archive to its content
+	bundle := make(map[string]string)
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	vms := make(chan string, numWorkers)
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for vmName := range vms {
+				items := nodeDiagnostics
+				if slices.Contains(cluster.LBNames(), vmName) {
+					items = lbDiagnostics(cluster.LoadBalancer())
+				}
+				if !(&Instance{Name: vmName}).IsRunning() {
+					Logger.Warn("vm is not running, skipping logs collection", "instance-name", vmName)
+					continue
+				}
+				files := collectItems(vmName, items)
+				mux.Lock()
+				for name, content := range files {
+					bundle[filepath.Join(vmName, name)] = content
+				}
+				mux.Unlock()
+				Logger.Info("logs collected", "instance-name", vmName)
+			}
+		}()
+	}
+	for _, vmName := range append(cluster.NodeNames(), cluster.LBNames()...) {
+		vms <- vmName
+	}
+	close(vms)
+	wg.Wait()
+
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	if (&Instance{Name: firstCtrlName}).IsRunning() {
+		for name, content := range collectItems(firstCtrlName, clusterDiagnostics) {
+			bundle[filepath.Join("cluster", name)] = content
+		}
+	}
+	if kmpassDir, err := KmpassDir(); err == nil {
+		names := append(slices.Clone(hostArtifacts), filepath.Join(cluster.Name, stateFileName))
+		for _, pool := range cluster.WorkerPoolNames() {
+			names = append(names, "cloudinit-"+pool+".yaml")
+		}
+		for _, name := range names {
+			content, err := os.ReadFile(filepath.Join(kmpassDir, name))
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(filepath.Base(name), "cloudinit") {
+				content = []byte(decodeCloudInit(string(content)))
+			}
+			bundle[filepath.Join("host", filepath.Base(name))] = string(content)
+		}
+	}
+
+	if outDir == "" {
+		dir, err := ClusterDir(cluster.Name)
+		if err != nil {
+			return "", err
+		}
+		outDir = dir
+	}
+	bundleName := fmt.Sprintf("%s-logs-%s", cluster.Name, time.Now().Format("20060102-150405"))
+	archivePath := filepath.Join(outDir, bundleName+".tar.gz")
+	secrets := append([]string{cluster.BootstrapToken, cluster.KubernetesCertKey, cluster.LB.StatsPassword,
+		cluster.RegistryPassword}, cluster.Proxy.passwords()...)
+	if err := writeBundle(archivePath, bundleName, bundle, secrets...); err != nil {
+		Logger.Error("unable to write diagnostics bundle", "err", err, "path", archivePath)
+		return "", err
+	}
+	return archivePath, nil
+}
+
+// writeBundle writes the files of the bundle, redacted, in a tar.gz archive under the root directory.
+func writeBundle(archivePath string, root string, bundle map[string]string, secrets ...string) error {
+	f, err := os.OpenFile(archivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return ErrCreateFile
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for name, content := range bundle {
+		content = redact(content, secrets...)
+		header := &tar.Header{
+			Name:    filepath.Join(root, name),
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,430 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CheckStatus is the outcome of a doctor check.
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// multipassStorageDir is where the multipass snap stores VM images on Linux hosts.
+const multipassStorageDir = "/var/snap/multipass/common"
+
+// CheckResult is the result of a single doctor check. Fix is a suggested remediation, set when the check did not pass.
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Target  string      `json:"target,omitempty"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Fix     string      `json:"fix,omitempty"`
+}
+
+// DoctorReport gathers the results of all the checks run against the host and a cluster.
+type DoctorReport struct {
+	Cluster string        `json:"cluster"`
+	Checks  []CheckResult `json:"checks"`
+}
+
+// Failed returns true if at least one check failed.
+func (report *DoctorReport) Failed() bool {
+	for _, check := range report.Checks {
+		if check.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *DoctorReport) add(name string, target string, status CheckStatus, message string, fix string) {
+	report.Checks = append(report.Checks, CheckResult{
+		Name:    name,
+		Target:  target,
+		Status:  status,
+		Message: message,
+		Fix:     fix,
+	})
+}
+
+// Diagnose runs the host and cluster checks that are usually done by hand when a cluster creation fails: multipass
+// health, free resources, leftover VMs and files, cloud-init completion, kubernetes services and load balancer
+// backends health. Cluster checks are skipped if the cluster state cannot be found on the host.
+func Diagnose(clusterName string) *DoctorReport {
+	report := &DoctorReport{Cluster: clusterName}
+	cluster, err := LoadState(clusterName)
+	if err != nil {
+		report.add("cluster-state", clusterName, CheckWarn, err.Error(),
+			"create the cluster with kmpass first, only host checks were run")
+		cluster = nil
+	}
+	instances := report.checkMultipass()
+	report.checkResources(cluster, instances)
+	report.checkLeftoverVMs(clusterName, cluster, instances)
+	report.checkStaleFiles(clusterName, instances)
+	if cluster == nil {
+		return report
+	}
+	for _, name := range cluster.NodeNames() {
+		if report.checkNodeRunning(name) {
+			report.checkCloudInit(name)
+			report.checkServices(name, "kubelet", "containerd")
+		}
+	}
+	report.checkAPIEndpoint(cluster)
+	for _, lbName := range cluster.LBNames() {
+		if !report.checkNodeRunning(lbName) {
+			continue
+		}
+		report.checkCloudInit(lbName)
+		lb := cluster.LoadBalancer()
+		if cluster.LBHighAvailability {
+			report.checkServices(lbName, lb.Service(), "keepalived")
+		} else {
+			report.checkServices(lbName, lb.Service())
+		}
+		report.checkLBBackends(lb, lbName)
+	}
+	return report
+}
+
+// checkMultipass verifies that the multipass client is installed and that its daemon answers. Returns the VMs known
+// by multipass, or nil if the daemon is not reachable.
+func (report *DoctorReport) checkMultipass() []InstanceInfo {
+	version, err := MultipassVersion()
+	if err != nil {
+		report.add("multipass-version", "host", CheckFail, "cannot get multipass version: "+err.Error(),
+			"install multipass, see https://multipass.run/install")
+	} else {
+		report.add("multipass-version", "host", CheckPass, "multipass "+version, "")
+	}
+	instances, err := ListInstances()
+	if err != nil {
+		report.add("multipass-daemon", "host", CheckFail, "multipass daemon is not reachable: "+err.Error(),
+			"restart the daemon, eg: sudo snap restart multipass")
+		return nil
+	}
+	report.add("multipass-daemon", "host", CheckPass, fmt.Sprintf("daemon reachable, %d VMs", len(instances)), "")
+	return instances
+}
+
+// checkResources compares the host free memory and disk with what the VMs of the cluster not yet created need.
+func (report *DoctorReport) checkResources(cluster *Cluster, instances []InstanceInfo) {
+	if cluster == nil {
+		return
+	}
+	existing := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		existing[instance.Name] = true
+	}
+	var needMemory, needDisk uint64
+	add := func(name string, memory string, disk string) {
+		if existing[name] {
+			return
+		}
+		mem, _ := parseSize(memory)
+		dsk, _ := parseSize(disk)
+		needMemory += mem
+		needDisk += dsk
+	}
+	for i := 0; i < cluster.CtrlNodesNumber; i++ {
+		add(fmt.Sprintf("%s-ctrl-%d", cluster.Name, i), cluster.CtrlNodesMemory, cluster.CtrlNodesDiskSize)
+	}
+	for _, pool := range cluster.workerPools() {
+		for _, name := range pool.nodeNames(cluster.Name) {
+			add(name, pool.Memory, pool.DiskSize)
+		}
+	}
+	for _, lbName := range cluster.LBNames() {
+		add(lbName, cluster.LBNodeMemory, cluster.LBNodeDiskSize)
+	}
+	if storageName := cluster.storageVMName(); storageName != "" {
+		diskSize := cluster.StorageDiskSize
+		if diskSize == "" {
+			diskSize = defaultStorageDiskSize
+		}
+		add(storageName, "1G", diskSize)
+	}
+	if registryName := cluster.registryVMName(); registryName != "" {
+		add(registryName, "1G", defaultRegistryDiskSize)
+	}
+
+	freeMemory, err := hostAvailableMemory()
+	switch {
+	case err != nil:
+		report.add("host-memory", "host", CheckWarn, "cannot read available memory: "+err.Error(), "")
+	case freeMemory < needMemory:
+		report.add("host-memory", "host", CheckWarn,
+			fmt.Sprintf("%s available, VMs to create need %s", humanSize(freeMemory), humanSize(needMemory)),
+			"reduce -cmem/-wmem/-lmem or the number of nodes, or stop other VMs")
+	default:
+		report.add("host-memory", "host", CheckPass, humanSize(freeMemory)+" available", "")
+	}
+
+	storageDir := multipassStorageDir
+	if _, err := os.Stat(storageDir); err != nil {
+		storageDir = "/"
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(storageDir, &fs); err != nil {
+		report.add("host-disk", "host", CheckWarn, "cannot read free disk space: "+err.Error(), "")
+		return
+	}
+	freeDisk := uint64(fs.Bavail) * uint64(fs.Bsize)
+	if freeDisk < needDisk {
+		report.add("host-disk", "host", CheckFail,
+			fmt.Sprintf("%s free in %s, VMs to create need %s", humanSize(freeDisk), storageDir, humanSize(needDisk)),
+			"free some disk space or reduce -cdisk/-wdisk/-ldisk")
+		return
+	}
+	report.add("host-disk", "host", CheckPass, fmt.Sprintf("%s free in %s", humanSize(freeDisk), storageDir), "")
+}
+
+// checkLeftoverVMs looks for VMs named after the cluster which are not part of it, and for deleted VMs that were
+// not purged and still hold their name and disk.
+func (report *DoctorReport) checkLeftoverVMs(clusterName string, cluster *Cluster, instances []InstanceInfo) {
+	expected := make(map[string]bool)
+	if cluster != nil {
+		for _, name := range cluster.NodeNames() {
+			expected[name] = true
+		}
+		for _, lbName := range cluster.LBNames() {
+			expected[lbName] = true
+		}
+		if storageName := cluster.storageVMName(); storageName != "" {
+			expected[storageName] = true
+		}
+		if registryName := cluster.registryVMName(); registryName != "" {
+			expected[registryName] = true
+		}
+	}
+	var leftovers, deleted []string
+	for _, instance := range instances {
+		if instance.State == "Deleted" {
+			deleted = append(deleted, instance.Name)
+			continue
+		}
+		if strings.HasPrefix(instance.Name, clusterName+"-") && !expected[instance.Name] {
+			leftovers = append(leftovers, instance.Name)
+		}
+	}
+	if len(leftovers) > 0 {
+		report.add("leftover-vms", clusterName, CheckFail,
+			"VMs not part of the cluster use its name prefix: "+strings.Join(leftovers, ", "),
+			"multipass delete --purge "+strings.Join(leftovers, " "))
+	} else {
+		report.add("leftover-vms", clusterName, CheckPass, "no leftover VM", "")
+	}
+	if len(deleted) > 0 {
+		report.add("deleted-vms", "host", CheckWarn, "deleted VMs are not purged: "+strings.Join(deleted, ", "),
+			"multipass purge")
+	}
+}
+
+// checkStaleFiles looks for cluster directories in ~/kmpass whose VMs no longer exist and for shared rendered
+// artifacts generated for another cluster.
+func (report *DoctorReport) checkStaleFiles(clusterName string, instances []InstanceInfo) {
+	kmpassDir, err := KmpassDir()
+	if err != nil {
+		report.add("stale-files", "host", CheckWarn, err.Error(), "")
+		return
+	}
+	var stale []string
+	entries, _ := os.ReadDir(kmpassDir)
+	for _, entry := range entries {
+		if !entry.IsDir() || instances == nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(kmpassDir, entry.Name(), stateFileName)); err != nil {
+			continue
+		}
+		alive := false
+		for _, instance := range instances {
+			if strings.HasPrefix(instance.Name, entry.Name()+"-") {
+				alive = true
+				break
+			}
+		}
+		if !alive && entry.Name() != clusterName {
+			stale = append(stale, filepath.Join(kmpassDir, entry.Name()))
+		}
+	}
+	if len(stale) > 0 {
+		report.add("stale-files", "host", CheckWarn, "cluster directories without VMs: "+strings.Join(stale, ", "),
+			"rm -rf "+strings.Join(stale, " "))
+	}
+	kubeadmConf := filepath.Join(kmpassDir, "cluster.yaml")
+	owner := renderedClusterName(kubeadmConf)
+	if owner != "" && owner != clusterName {
+		report.add("rendered-files", "host", CheckWarn,
+			fmt.Sprintf("artifacts in %s were rendered for cluster %s", kmpassDir, owner),
+			"they are regenerated by the next create, do not reuse them for "+clusterName)
+		return
+	}
+	if len(stale) == 0 {
+		report.add("stale-files", "host", CheckPass, "no stale file in "+kmpassDir, "")
+	}
+}
+
+// renderedClusterName returns the cluster name found in a rendered kubeadm configuration file, or an empty string.
+func renderedClusterName(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "clusterName:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "clusterName:"))
+		}
+	}
+	return ""
+}
+
+// checkNodeRunning checks the VM state and returns true if the VM is running.
+func (report *DoctorReport) checkNodeRunning(name string) bool {
+	vm := &Instance{Name: name}
+	switch state := vm.state(); state {
+	case "Running":
+		report.add("vm-state", name, CheckPass, "running", "")
+		return true
+	case "NotExist":
+		report.add("vm-state", name, CheckFail, "VM does not exist", "run the kmpass create command again")
+	default:
+		report.add("vm-state", name, CheckFail, "VM state is "+state, "multipass start "+name)
+	}
+	return false
+}
+
+// checkCloudInit checks that cloud-init, and hence the node bootstrap script, finished on a node.
+func (report *DoctorReport) checkCloudInit(name string) {
+	out, _ := RunCmd(name, []string{"cloud-init", "status"})
+	switch {
+	case strings.Contains(out, "status: done"):
+		report.add("cloud-init", name, CheckPass, "done", "")
+	case strings.Contains(out, "status: running"):
+		report.add("cloud-init", name, CheckWarn, "still running",
+			"wait for it: multipass exec "+name+" -- cloud-init status --wait")
+	default:
+		report.add("cloud-init", name, CheckFail, strings.TrimSpace(out),
+			"multipass exec "+name+" -- tail -n 100 /var/log/cloud-init-output.log")
+	}
+}
+
+// checkServices checks that systemd services are active on a node.
+func (report *DoctorReport) checkServices(name string, services ...string) {
+	// systemctl is-active exits with non 0 status if a service is not active, the output is still usable
+	out, _ := RunCmd(name, append([]string{"systemctl", "is-active"}, services...))
+	states := strings.Fields(out)
+	for i, service := range services {
+		state := "unknown"
+		if i < len(states) {
+			state = states[i]
+		}
+		if state == "active" {
+			report.add(service, name, CheckPass, "active", "")
+			continue
+		}
+		report.add(service, name, CheckFail, service+" is "+state,
+			fmt.Sprintf("multipass exec %s -- sudo journalctl -u %s --no-pager -n 100", name, service))
+	}
+}
+
+// checkAPIEndpoint checks that the kube API answers ready on the cluster public endpoint.
+func (report *DoctorReport) checkAPIEndpoint(cluster *Cluster) {
+	if cluster.PublicAPIEndpoint == "" {
+		report.add("api-endpoint", cluster.Name, CheckFail, "the cluster has no API endpoint yet",
+			"the load balancer was not created, run the kmpass create command again")
+		return
+	}
+	if !apiReachable(cluster.PublicAPIEndpoint) {
+		fix := "check the kube-apiserver pods and the load balancer"
+		if cluster.LBMode == LBModeKubeVIP {
+			fix = "check the kube-vip static pods: multipass exec " + cluster.Name + "-ctrl-0 -- sudo crictl ps --name kube-vip"
+		}
+		report.add("api-endpoint", cluster.PublicAPIEndpoint, CheckFail, "kube API is not ready", fix)
+		return
+	}
+	report.add("api-endpoint", cluster.PublicAPIEndpoint, CheckPass, "kube API ready", "")
+}
+
+// checkLBBackends reads the backends status from the load balancer. A kube API backend down is a failure, other
+// backends being down is only a warning as nothing may listen on them yet.
+func (report *DoctorReport) checkLBBackends(lb LoadBalancer, lbName string) {
+	backends, err := lb.Backends(lbName)
+	if err != nil {
+		report.add("lb-backends", lbName, CheckFail, "cannot read backends status: "+err.Error(),
+			"check the load balancer configuration: multipass exec "+lbName+" -- "+
+				strings.Join(lb.CheckCmd(lb.ConfigPath()), " "))
+		return
+	}
+	down := make(map[string][]string)
+	var listeners []string
+	for _, backend := range backends {
+		if _, ok := down[backend.Listener]; !ok {
+			down[backend.Listener] = nil
+			listeners = append(listeners, backend.Listener)
+		}
+		if !backend.Up {
+			down[backend.Listener] = append(down[backend.Listener], backend.Server+" "+backend.Status)
+		}
+	}
+	for _, listener := range listeners {
+		servers := down[listener]
+		switch {
+		case len(servers) == 0:
+			report.add("lb-backends", lbName+"/"+listener, CheckPass, "all servers up", "")
+		case strings.HasPrefix(listener, "kube-api"):
+			report.add("lb-backends", lbName+"/"+listener, CheckFail, "servers down: "+strings.Join(servers, ", "),
+				"check the kube-apiserver pods on the control nodes and the IPs in "+lb.ConfigPath())
+		default:
+			report.add("lb-backends", lbName+"/"+listener, CheckWarn, "servers down: "+strings.Join(servers, ", "),
+				"nothing may listen on this port on the nodes yet")
+		}
+	}
+}
+
+// hostAvailableMemory returns the memory available on the host, in bytes.
+func hostAvailableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb << 10, nil
+		}
+	}
+	return 0, ErrUnexpectedOutput
+}
+
+// humanSize formats a number of bytes in the same unit format as the instance sizes.
+func humanSize(size uint64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(size)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1fK", float64(size)/(1<<10))
+	}
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHaproxyStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []haproxyStat
+		wantErr bool
+	}{
+		{
+			name: "stats_good",
+			out: "# pxname,svname,qcur,qmax,status,weight\n" +
+				"kube-api-6443,FRONTEND,,,OPEN,\n" +
+				"kube-api-6443,ctrl0,0,0,UP,1\n" +
+				"kube-api-6443,ctrl1,0,0,DOWN,1\n" +
+				"kube-api-6443,BACKEND,0,0,UP,1\n",
+			want: []haproxyStat{
+				{Proxy: "kube-api-6443", Server: "FRONTEND", Status: "OPEN"},
+				{Proxy: "kube-api-6443", Server: "ctrl0", Status: "UP"},
+				{Proxy: "kube-api-6443", Server: "ctrl1", Status: "DOWN"},
+				{Proxy: "kube-api-6443", Server: "BACKEND", Status: "UP"},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "stats_no_status_column",
+			out:     "# pxname,svname\nkube-api-6443,ctrl0\n",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "stats_empty",
+			out:     "",
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHaproxyStats(tt.out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseHaproxyStats() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHaproxyStats() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{name: "size_kilo", size: "512k", want: 512 << 10, wantErr: false},
+		{name: "size_mega", size: "256M", want: 256 << 20, wantErr: false},
+		{name: "size_giga", size: "4G", want: 4 << 30, wantErr: false},
+		{name: "size_bad_format", size: "4Gg", want: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// envoyAdminAddress is the address of the Envoy admin interface on the LB VMs. It is not authenticated, so it only
+// listens on localhost.
+const envoyAdminAddress = "127.0.0.1:9901"
+
+// envoyUnit is the systemd unit of Envoy, the Envoy package does not ship one.
+const envoyUnit = `[Unit]
+Description=Envoy load balancer
+After=network-online.target
+
+[Service]
+ExecStart=/usr/bin/envoy -c /etc/envoy/envoy.yaml
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// envoyLB is the Envoy load balancer. Servers are actively health checked by Envoy and their health is read from the
+// admin interface.
+type envoyLB struct{}
+
+func (envoyLB) Service() string {
+	return "envoy"
+}
+
+func (envoyLB) InstallScript() string {
+	return "apt-get install -y curl gnupg lsb-release && mkdir -p /etc/apt/keyrings /etc/envoy && " +
+		"curl -fsSL https://apt.envoyproxy.io/signing.key | gpg --dearmor -o /etc/apt/keyrings/envoy-keyring.gpg && " +
+		"echo \"deb [signed-by=/etc/apt/keyrings/envoy-keyring.gpg] https://apt.envoyproxy.io $(lsb_release -cs) main\"" +
+		" > /etc/apt/sources.list.d/envoy.list && apt-get update && apt-get install -y envoy && " +
+		fmt.Sprintf("printf '%%s' '%s' > /etc/systemd/system/envoy.service && ", envoyUnit) +
+		"systemctl daemon-reload && systemctl enable envoy"
+}
+
+func (envoyLB) Template() string {
+	return "app/files/envoy.yaml.tpl"
+}
+
+func (envoyLB) ConfigPath() string {
+	return "/etc/envoy/envoy.yaml"
+}
+
+func (envoyLB) CheckCmd(path string) []string {
+	return []string{"sudo", "envoy", "--mode", "validate", "-c", path}
+}
+
+// ReloadCmd restarts Envoy, hot restart needs a wrapper process which is not worth it for a local cluster. Open
+// connections are dropped.
+func (envoyLB) ReloadCmd() string {
+	return "systemctl restart envoy"
+}
+
+func (envoyLB) Backends(lbName string) ([]LBBackend, error) {
+	out, err := RunCmd(lbName, []string{"curl", "-sf", "http://" + envoyAdminAddress + "/clusters"})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+	}
+	return parseEnvoyClusters(out), nil
+}
+
+// parseEnvoyClusters reads the health of the servers from the output of the Envoy admin /clusters endpoint, eg:
+// kube-api-6443::10.1.1.10:6443::health_flags::/failed_active_hc
+func parseEnvoyClusters(out string) []LBBackend {
+	var backends []LBBackend
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "::")
+		if len(fields) != 4 || fields[2] != "health_flags" {
+			continue
+		}
+		backend := LBBackend{Listener: fields[0], Server: fields[1], Status: "UP", Up: fields[3] == "healthy"}
+		if !backend.Up {
+			backend.Status = "DOWN " + fields[3]
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// EnvoyPolicy returns the Envoy load balancing policy of the frontend.
+func (frontend lbFrontend) EnvoyPolicy() string {
+	if frontend.Balance == "leastconn" {
+		return "LEAST_REQUEST"
+	}
+	return "ROUND_ROBIN"
+}
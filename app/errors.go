@@ -20,4 +20,54 @@ var (
 	ErrCloudInitGeneration  = errors.New("unable to generate cloud init file")
 	ErrClusterConfiguration = errors.New("wrong value in cluster configuration")
 	ErrOddNumberCtrlNode    = errors.New("number of control nodes should be odd")
+	ErrClusterStateNotFound = errors.New("cluster state not found, was the cluster created by kmpass?")
+	ErrUnexpectedOutput     = errors.New("unexpected command output")
+	ErrInvalidKubeVersion   = errors.New("kubernetes version should be like 1.x.y")
+	ErrKubeVersionSkew      = errors.New("upgrade should target a newer patch of the current minor or the next minor version")
+	ErrLBBackendsDown       = errors.New("load balancer backends are not healthy")
+	ErrSnapshotName         = errors.New("snapshot name should start with a letter and contain only letters, digits and hyphens")
+	ErrSnapshotExist        = errors.New("snapshot already exist")
+	ErrSnapshotNotFound     = errors.New("snapshot not found")
+	ErrNoFreeVirtualIP      = errors.New("no free virtual IP found in the multipass subnet")
+	ErrNoActiveLB           = errors.New("no LB node holds the virtual IP")
+	ErrLBNotHighlyAvailable = errors.New("cluster was not created with a highly available LB pair")
+	ErrAPIUnreachable       = errors.New("kube API is not reachable")
+	ErrInvalidLBConfig      = errors.New("load balancer configuration is invalid")
+	ErrLBPort               = errors.New("load balancer port should be between 1 and 65535")
+	ErrLBPortCollision      = errors.New("load balancer port is already used by another listener")
+	ErrLBPool               = errors.New("load balancer listener pool should be control, worker or a worker pool name")
+	ErrInvalidSpec          = errors.New("invalid cluster spec file")
+	ErrLBMode               = errors.New("load balancer mode should be haproxy, nginx, envoy or kube-vip, kube-vip cannot be used with a LB pair")
+	ErrLBBalance            = errors.New("load balancer balance algorithm should be roundrobin or leastconn")
+	ErrLBListenerName       = errors.New("load balancer listener name should be unique, made of letters, digits, '-', '_' or '.', and not a kmpass listener name")
+	ErrInvalidIPRange       = errors.New("IP range should be like 10.1.1.200-10.1.1.220")
+	ErrNoFreeServiceLBRange = errors.New("no free address range found outside the multipass DHCP pool for the LoadBalancer services, set the range")
+	ErrKubeProxyReplacement = errors.New("cilium LB-IPAM and ingress need the cilium kube-proxy replacement, set at the cluster creation")
+	ErrServiceLBProvider    = errors.New("service LB provider should be cilium or metallb")
+	ErrIngressController    = errors.New("ingress controller should be nginx or cilium")
+	ErrIngressUnreachable   = errors.New("test ingress is not reachable through the load balancer")
+	ErrUnknownAddon         = errors.New("unknown addon, run kmpass addons list to see the available ones")
+	ErrAddonCycle           = errors.New("addon dependencies loop")
+	ErrAddonNotReady        = errors.New("addon is not healthy")
+	ErrStorage              = errors.New("storage should be lb or vm, lb cannot be used in kube-vip mode")
+	ErrRegistry             = errors.New("registry should be lb or vm, lb cannot be used in kube-vip mode")
+	ErrNodePool             = errors.New("node pool should be control, worker or a worker pool name")
+	ErrNoImage              = errors.New("an image tarball or at least one image name is required")
+	ErrLoadImage            = errors.New("images could not be loaded on any node")
+	ErrRegistryMirror       = errors.New("registry mirrors should be like docker.io=https://mirror.gcr.io")
+	ErrPullCache            = errors.New("pull-through cache runs on the LB node, it cannot be used in kube-vip mode")
+	ErrArtifactsNotFound    = errors.New("artifact cache not found, run kmpass cache pull first")
+	ErrArtifactChecksum     = errors.New("artifact cache is corrupted, run kmpass cache pull again")
+	ErrArtifactsArch        = errors.New("artifact cache was pulled for another architecture, run kmpass cache pull on this host")
+	ErrOfflineFeature       = errors.New("envoy, storage, registry, pull-cache, ingress, addons and metallb download from the internet, they cannot be used offline")
+	ErrProxy                = errors.New("proxy should be an http or https URL, eg: http://proxy.corp:3128")
+	ErrCACert               = errors.New("CA bundle should be a readable PEM file with at least one certificate")
+	ErrSSHKey               = errors.New("SSH authorized keys should be OpenSSH public keys, eg: ssh-ed25519 AAAA... user@host")
+	ErrNoLBNode             = errors.New("cluster has no LB node in kube-vip mode")
+	ErrNoMultipassBridge    = errors.New("multipass network not found on the host, set the artifact server address")
+	ErrCloudInitFragment    = errors.New("cloud init fragment should be a readable cloud config file starting with #cloud-config")
+	ErrNodeLabel            = errors.New("node labels should be valid kubernetes labels the kubelet can set, eg: disk=ssd")
+	ErrNodeTaint            = errors.New("node taints should be like dedicated=gpu with a NoSchedule, PreferNoSchedule or NoExecute effect")
+	ErrWorkerPool           = errors.New("worker pools should have unique lowercase names, other than cmp, ctrl, control, worker, nfs and registry and not starting with lb, and a positive size")
+	ErrCloudInitSchema      = errors.New("cloud init file is invalid, check the cloud init fragments")
 )
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// etcdctlFlags are the flags used to reach the local etcd member of a control node with the kubeadm etcd certs.
+var etcdctlFlags = []string{
+	"--endpoints=https://127.0.0.1:2379",
+	"--cacert=/etc/kubernetes/pki/etcd/ca.crt",
+	"--cert=/etc/kubernetes/pki/etcd/server.crt",
+	"--key=/etc/kubernetes/pki/etcd/server.key",
+}
+
+const (
+	// remoteEtcdSnapshot is the path of the etcd snapshot file in the control nodes.
+	remoteEtcdSnapshot = "/tmp/etcd-snapshot.db"
+	// stoppedManifestsDir is where the static pod manifests are moved to stop the control plane during a restore.
+	stoppedManifestsDir = "/etc/kubernetes/manifests.kmpass"
+)
+
+// BackupEtcd takes a snapshot of the etcd database from the first control node and copies it to the cluster
+// directory on the host. etcdctl is run inside the etcd static pod container, with the kubeadm etcd certs. Returns
+// the path of the snapshot on the host.
+func (cluster *Cluster) BackupEtcd() (string, error) {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	// /var/lib/etcd is mounted in the etcd container, the snapshot is written there and moved out on the node
+	script := fmt.Sprintf("crictl exec $(crictl ps --name etcd -q | head -n 1) etcdctl %s snapshot save "+
+		"/var/lib/etcd/kmpass-snapshot.db && mv /var/lib/etcd/kmpass-snapshot.db %s && chown ubuntu:ubuntu %[2]s",
+		strings.Join(etcdctlFlags, " "), remoteEtcdSnapshot)
+	if out, err := RunCmd(firstCtrlName, []string{"sudo", "sh", "-c", script}); err != nil {
+		Logger.Error("etcd snapshot failed", "err", err, "output", out, "cluster", cluster.Name)
+		return "", err
+	}
+	dir, err := ClusterDir(cluster.Name)
+	if err != nil {
+		return "", err
+	}
+	snapshotPath := filepath.Join(dir, fmt.Sprintf("etcd-%s.db", time.Now().Format("20060102-150405")))
+	if err := TransferFrom(firstCtrlName, remoteEtcdSnapshot, snapshotPath); err != nil {
+		return "", err
+	}
+	if _, err := RunCmd(firstCtrlName, []string{"rm", "-f", remoteEtcdSnapshot}); err != nil {
+		Logger.Warn("unable to remove etcd snapshot from the control node", "instance-name", firstCtrlName)
+	}
+	Logger.Info("etcd snapshot saved", "cluster", cluster.Name, "path", snapshotPath)
+	return snapshotPath, nil
+}
+
+// RestoreEtcd restores the etcd database of every control node from a snapshot taken with BackupEtcd, following the
+// documented multi-member restore: the control plane static pods are stopped on all the control nodes, each member
+// data directory is rebuilt from the snapshot with etcdutl and the same initial cluster, then the control plane is
+// started again. The previous data directory is kept as /var/lib/etcd.kmpass-old.
+func (cluster *Cluster) RestoreEtcd(snapshotPath string) error {
+	ctrlNames := cluster.NodeNames()[:cluster.CtrlNodesNumber]
+	peers := make([]string, 0, len(ctrlNames))
+	peerURLs := make(map[string]string, len(ctrlNames))
+	for _, name := range ctrlNames {
+		IP, err := (&Instance{Name: name}).GetIP()
+		if err != nil {
+			Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", name)
+			return err
+		}
+		peerURLs[name] = fmt.Sprintf("https://%s:2380", IP)
+		peers = append(peers, fmt.Sprintf("%s=%s", name, peerURLs[name]))
+	}
+	// the etcd image, which ships etcdutl, is read before its manifest is moved away
+	etcdImage, err := RunCmd(ctrlNames[0], []string{"sudo", "sh", "-c",
+		"grep 'image:' /etc/kubernetes/manifests/etcd.yaml | awk '{print $2}'"})
+	etcdImage = strings.TrimSpace(etcdImage)
+	if err != nil || etcdImage == "" {
+		Logger.Error("unable to find etcd image", "err", err, "cluster", cluster.Name)
+		return ErrUnexpectedOutput
+	}
+
+	for _, name := range ctrlNames {
+		if err := Transfer(name, snapshotPath, filepath.Base(remoteEtcdSnapshot)); err != nil {
+			return err
+		}
+	}
+	// 1. stop the control plane everywhere before touching the data
+	for _, name := range ctrlNames {
+		script := fmt.Sprintf("mv /etc/kubernetes/manifests %s && "+
+			"while [ -n \"$(crictl ps --name 'etcd|kube-apiserver' -q)\" ]; do sleep 2; done", stoppedManifestsDir)
+		if out, err := RunCmd(name, []string{"sudo", "sh", "-c", script}); err != nil {
+			Logger.Error("unable to stop the control plane", "err", err, "output", out, "instance-name", name)
+			return err
+		}
+	}
+	// 2. rebuild every member from the snapshot
+	for _, name := range ctrlNames {
+		script := fmt.Sprintf("rm -rf /var/lib/etcd.kmpass-old && mv /var/lib/etcd /var/lib/etcd.kmpass-old && "+
+			"ctr -n k8s.io run --rm --mount type=bind,src=/var/lib,dst=/var/lib,options=rbind:rw "+
+			"--mount type=bind,src=/tmp,dst=/tmp,options=rbind:ro %s kmpass-etcd-restore "+
+			"etcdutl snapshot restore %s --name %s --initial-cluster %s --initial-advertise-peer-urls %s "+
+			"--data-dir /var/lib/etcd",
+			etcdImage, remoteEtcdSnapshot, name, strings.Join(peers, ","), peerURLs[name])
+		if out, err := RunCmd(name, []string{"sudo", "sh", "-c", script}); err != nil {
+			Logger.Error("etcd restore failed", "err", err, "output", out, "instance-name", name)
+			return err
+		}
+		Logger.Info("etcd member restored", "instance-name", name)
+	}
+	// 3. start the control plane again
+	for _, name := range ctrlNames {
+		script := fmt.Sprintf("mv %s /etc/kubernetes/manifests && rm -f %s", stoppedManifestsDir, remoteEtcdSnapshot)
+		if out, err := RunCmd(name, []string{"sudo", "sh", "-c", script}); err != nil {
+			Logger.Error("unable to start the control plane", "err", err, "output", out, "instance-name", name)
+			return err
+		}
+	}
+	if err := cluster.waitAPIHealthy(lbBackendsTimeout); err != nil {
+		Logger.Error("kube API is not back after etcd restore", "err", err, "cluster", cluster.Name)
+		return err
+	}
+	Logger.Info("etcd restored", "cluster", cluster.Name, "snapshot", snapshotPath)
+	return nil
+}
@@ -0,0 +1,56 @@
+#!/bin/bash
+# Downloads the artifacts installed on the nodes by install.sh, for kubernetes {{.Version}}, in a tarball served to
+# the VMs by kmpass in offline mode.
+set -euo pipefail
+export DEBIAN_FRONTEND=noninteractive
+OUT=/tmp/kmpass-cache
+rm -rf $OUT /tmp/kmpass-cache.tar.gz
+mkdir -p $OUT/debs $OUT/bin $OUT/images
+# The builder VM runs the nodes image on the host, the artifacts are those of the nodes architecture
+ARCH=$(dpkg --print-architecture)
+echo "$ARCH" > $OUT/arch
+
+# Same repositories as install.sh
+apt-get update
+apt-get install -y curl gnupg software-properties-common dpkg-dev
+curl -s https://packages.cloud.google.com/apt/doc/apt-key.gpg | apt-key add -
+echo "deb https://apt.kubernetes.io/ kubernetes-xenial main" > /etc/apt/sources.list.d/kubernetes.list
+curl -fsSL https://download.docker.com/linux/ubuntu/gpg | apt-key add -
+add-apt-repository -y "deb [arch=$ARCH] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable"
+apt-get update
+
+# Packages and their dependencies missing from the VM image, as a flat repository
+apt-get clean
+apt-get install -y --download-only kubelet={{.AptVersion}} kubeadm={{.AptVersion}} kubectl={{.AptVersion}} containerd.io
+{{- range .Packages}} {{.}}{{end}}
+cp /var/cache/apt/archives/*.deb $OUT/debs/
+(cd $OUT/debs && dpkg-scanpackages . /dev/null | gzip -9c > Packages.gz)
+
+# Binaries, checked against their published checksums
+cd $OUT/bin
+curl -fsSLO https://github.com/kubernetes-sigs/cri-tools/releases/download/{{.CrictlVersion}}/crictl-{{.CrictlVersion}}-linux-${ARCH}.tar.gz{,.sha256}
+echo "$(cat crictl-{{.CrictlVersion}}-linux-${ARCH}.tar.gz.sha256)  crictl-{{.CrictlVersion}}-linux-${ARCH}.tar.gz" | sha256sum --check
+curl -fsSLO https://get.helm.sh/helm-{{.HelmVersion}}-linux-${ARCH}.tar.gz{,.sha256sum}
+sha256sum --check helm-{{.HelmVersion}}-linux-${ARCH}.tar.gz.sha256sum
+CILIUM_CLI_VERSION=$(curl -fsS https://raw.githubusercontent.com/cilium/cilium-cli/master/stable.txt)
+curl -fsSLO https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${ARCH}.tar.gz{,.sha256sum}
+sha256sum --check cilium-linux-${ARCH}.tar.gz.sha256sum
+rm -f *.sha256 *.sha256sum
+
+# Control plane images of kubeadm, the images of the cilium version installed by the cilium CLI and kube-vip
+apt-get install -y --allow-downgrades kubeadm={{.AptVersion}} containerd.io
+systemctl start containerd
+tar xzf cilium-linux-${ARCH}.tar.gz -C /usr/local/bin
+CILIUM_VERSION=$(cilium version --client | awk '/image \(default\)/ {print $NF}')
+IMAGES="$(kubeadm config images list --kubernetes-version {{.KubeVersion}}) quay.io/cilium/cilium:${CILIUM_VERSION} quay.io/cilium/operator-generic:${CILIUM_VERSION}
+{{- range .Images}} {{.}}{{end}}"
+for image in $IMAGES; do
+  ctr -n k8s.io images pull --platform linux/${ARCH} "$image" > /dev/null
+done
+ctr -n k8s.io images export --platform linux/${ARCH} $OUT/images/images.tar $IMAGES
+echo "$IMAGES" | tr ' ' '\n' > $OUT/images/images.txt
+
+cd $OUT
+sha256sum arch debs/*.deb bin/* images/images.tar > SHA256SUMS
+tar czf /tmp/kmpass-cache.tar.gz -C $OUT .
+chown ubuntu:ubuntu /tmp/kmpass-cache.tar.gz
@@ -7,16 +7,53 @@ users:
     sudo: ALL=(ALL) NOPASSWD:ALL
     groups: users, admin, docker, sudo
     shell: /bin/bash
+{{- if .SSHAuthorizedKeys}}
+    ssh_authorized_keys:
+{{- range .SSHAuthorizedKeys}}
+      - {{printf "%q" .}}
+{{- end}}
+{{- end}}
+{{- if .CACerts}}
 
-package_update: true
-package_upgrade: true
+ca_certs:
+  trusted:
+{{- range .CACerts}}
+    - |
+{{.}}
+{{- end}}
+{{- end}}
+
+package_update: {{not .Offline}}
+package_upgrade: {{not .Offline}}
+{{- if .Packages}}
+packages:
+{{- range .Packages}}
+  - {{.}}
+{{- end}}
+{{- end}}
+
+{{- if or .NodeBootstrapScript .Files}}
 
 write_files:
+{{- if .NodeBootstrapScript}}
 - encoding: b64
   owner: ubuntu:ubuntu
   path: /tmp/install.sh
   permissions: '1551'
   content: {{.NodeBootstrapScript}}
+{{- end}}
+{{- range .Files}}
+- encoding: b64
+  path: {{.Path}}
+  permissions: '0644'
+{{- if .Append}}
+  append: true
+{{- end}}
+  content: {{.Content}}
+{{- end}}
+{{- end}}
+{{- if .NodeBootstrapScript}}
 
 runcmd:
  - [ sudo, /tmp/install.sh ]
+{{- end}}
@@ -8,14 +8,33 @@ controlPlaneEndpoint: {{.PublicAPIEndpoint}}:6443
 apiServer:
   certSANs:
     - {{.PublicAPIEndpoint}}
+  {{- range .LBNodesIPs}}
+    - {{.}}
+  {{- end}}
 clusterName: {{.Name}}
 
 ---
 apiVersion: kubeadm.k8s.io/v1beta3
 kind: InitConfiguration
 certificateKey: {{.KubernetesCertKey}}
+{{- if .KubeProxyReplacement}}
+skipPhases:
+  - addon/kube-proxy
+{{- end}}
 bootstrapTokens:
 - token: {{.BootstrapToken}}
   description: "default kubeadm bootstrap token"
   ttl: "24h"
-
+nodeRegistration:
+{{- with .PoolNodeLabels "control"}}
+  kubeletExtraArgs:
+    node-labels: {{printf "%q" .}}
+{{- end}}
+  taints:
+{{- range .PoolTaints "control"}}
+    - key: {{printf "%q" .Key}}
+{{- if .Value}}
+      value: {{printf "%q" .Value}}
+{{- end}}
+      effect: {{.Effect}}
+{{- end}}
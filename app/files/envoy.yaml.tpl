@@ -0,0 +1,65 @@
+admin:
+  address:
+    socket_address: {address: 127.0.0.1, port_value: 9901}
+
+static_resources:
+  listeners:
+  {{- range .Frontends}}
+  - name: {{.Name}}
+    address:
+      socket_address: {address: 0.0.0.0, port_value: {{.Port}}}
+    filter_chains:
+    - filters:
+      - name: envoy.filters.network.tcp_proxy
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy
+          stat_prefix: {{.Name}}
+          cluster: {{.Name}}
+  {{- end}}
+  clusters:
+  {{- range .Frontends}}
+  - name: {{.Name}}
+    type: STATIC
+    connect_timeout: 5s
+    lb_policy: {{.EnvoyPolicy}}
+    load_assignment:
+      cluster_name: {{.Name}}
+      endpoints:
+      - lb_endpoints:{{if not .Servers}} []{{end}}
+        {{- range .Servers}}
+        - endpoint:
+            address:
+              socket_address: {address: {{.IP}}, port_value: {{.Port}}}
+        {{- end}}
+    health_checks:
+    - timeout: 2s
+      interval: 2s
+      unhealthy_threshold: 3
+      healthy_threshold: 2
+      {{- if .HTTPSCheck}}
+      # the API servers are only used once ready, the check does not need client certificates
+      http_health_check:
+        path: {{.HTTPSCheck}}
+      transport_socket_match_criteria:
+        health-check: tls
+      {{- else}}
+      tcp_health_check: {}
+      {{- end}}
+    {{- if .HTTPSCheck}}
+    # TLS is only used by the health checks, the traffic is proxied as is
+    transport_socket_matches:
+    - name: tls-health-check
+      match:
+        health-check: tls
+      transport_socket:
+        name: envoy.transport_sockets.tls
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+    - name: raw
+      match: {}
+      transport_socket:
+        name: envoy.transport_sockets.raw_buffer
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.transport_sockets.raw_buffer.v3.RawBuffer
+    {{- end}}
+  {{- end}}
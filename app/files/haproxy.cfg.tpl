@@ -2,6 +2,7 @@ global
   log /dev/log  local0
   log /dev/log  local1 notice
   chroot /var/lib/haproxy
+  stats socket /run/haproxy/admin.sock mode 660 level admin expose-fd listeners
   stats timeout 30s
   user haproxy
   group haproxy
@@ -37,34 +38,31 @@ defaults
 
 
 frontend stats
-    bind *:80
-    mode http
-    stats enable
-    stats uri /stats
-	monitor-uri     /monitoruri
-	stats auth admin:change_me_now
-    stats refresh 10s
+  bind *:{{.LB.StatsPort}}
+  mode http
+  stats enable
+  stats uri /stats
+  stats refresh 10s
+  stats auth {{.LB.StatsUser}}:{{.LB.StatsPassword}}
+  monitor-uri /monitoruri
 
-listen kube-api-6443
-  bind *:6443
-  mode tcp
-  {{- range $i, $ip := .CtrlNodesIPs}}
-  server ctrl{{$i }} {{$ip -}}:6443 check inter 1s backup
-  {{- end}}
+{{- range .Frontends}}
 
-listen ingress-router-443
-  bind *:443
+listen {{.Name}}
+  bind *:{{.Port}}
   mode tcp
-  balance source
-  {{- range $i, $ip := .CmpNodesIPs}}
-  server cmp{{$i }} {{$ip -}}:443 check inter 1s backup
+  balance {{.Balance}}
+  {{- if .HTTPSCheck}}
+  # the API servers are only used once ready, the check does not need client certificates
+  option httpchk GET {{.HTTPSCheck}}
+  http-check expect status 200
+  default-server inter 2s fall 3 rise 2
+  {{- range .Servers}}
+  server {{.Name}} {{.Address}} check check-ssl verify none
   {{- end}}
-
-listen ingress-router-80
-  bind *:80
-  mode tcp
-  balance source
-  {{- range $i, $ip := .CmpNodesIPs}}
-  server cmp{{$i }} {{$ip -}}:80 check inter 1s backup
+  {{- else}}
+  {{- range .Servers}}
+  server {{.Name}} {{.Address}} check inter 1s
   {{- end}}
-
+  {{- end}}
+{{- end}}
@@ -16,20 +16,52 @@ fi
 # on the control plane node.
 sudo touch ./k8s_run
 
-# Update the system
-sudo apt update ; sudo apt upgrade -y
+# Corporate proxy, the downloads of this script go through it
+if [ -f /etc/kmpass/proxy.env ]; then
+  set -a
+  . /etc/kmpass/proxy.env
+  set +a
+fi
 
-# Install necessary software
-sudo apt install curl apt-transport-https vim git wget gnupg2 software-properties-common apt-transport-https ca-certificates -y
+# Offline mode: kmpass serves the artifacts from the host cache, ARTIFACTS_URL is set in this file
+if [ -f /etc/kmpass/artifacts.env ]; then
+  . /etc/kmpass/artifacts.env
+fi
 
-# Add repo for Kubernetes
-curl -s https://packages.cloud.google.com/apt/doc/apt-key.gpg | sudo apt-key add -
-echo "deb https://apt.kubernetes.io/ kubernetes-xenial main" | sudo tee /etc/apt/sources.list.d/kubernetes.list
+# Architecture of the debs and binaries, eg: amd64 or arm64
+ARCH=$(dpkg --print-architecture)
+
+# fetch_artifact downloads a file of the host artifact cache and verifies its checksum
+fetch_artifact() {
+  curl -fsS "$ARTIFACTS_URL/$1" -o "$(basename "$1")" && \
+    grep " $1\$" /tmp/kmpass-SHA256SUMS | sed "s| $1\$| $(basename "$1")|" | sha256sum --check
+}
+
+if [ -n "$ARTIFACTS_URL" ]; then
+  # Only use the packages of the host artifact cache
+  curl -fsS "$ARTIFACTS_URL/SHA256SUMS" -o /tmp/kmpass-SHA256SUMS
+  echo "deb [trusted=yes] $ARTIFACTS_URL/debs ./" | sudo tee /etc/apt/sources.list.d/kmpass.list
+  sudo apt-get update -o Dir::Etc::sourcelist=sources.list.d/kmpass.list -o Dir::Etc::sourceparts=- \
+    -o APT::Get::List-Cleanup=0
+  sudo apt-get -y install kubelet=${KUBE_VERSION}-00 kubeadm=${KUBE_VERSION}-00 kubectl=${KUBE_VERSION}-00 \
+    containerd.io $EXTRA_PACKAGES
+  sudo apt-mark hold kubelet kubeadm kubectl
+else
+  # Update the system
+  sudo apt update ; sudo apt upgrade -y
 
-# Install the Kubernetes software, and lock the version
-sudo apt update
-sudo apt -y install kubelet=1.25.5-00 kubeadm=1.25.5-00 kubectl=1.25.5-00
-sudo apt-mark hold kubelet kubeadm kubectl
+  # Install necessary software
+  sudo apt install curl apt-transport-https vim git wget gnupg2 software-properties-common apt-transport-https ca-certificates -y
+
+  # Add repo for Kubernetes
+  curl -s https://packages.cloud.google.com/apt/doc/apt-key.gpg | sudo apt-key add -
+  echo "deb https://apt.kubernetes.io/ kubernetes-xenial main" | sudo tee /etc/apt/sources.list.d/kubernetes.list
+
+  # Install the Kubernetes software, and lock the version
+  sudo apt update
+  sudo apt -y install kubelet=1.25.5-00 kubeadm=1.25.5-00 kubectl=1.25.5-00
+  sudo apt-mark hold kubelet kubeadm kubectl
+fi
 
 # Ensure Kubelet is running
 sudo systemctl enable --now kubelet
@@ -58,25 +90,44 @@ EOF
 
 sudo sysctl --system
 
-# Install the containerd software
-curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -
-sudo add-apt-repository "deb [arch=amd64] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable"
-sudo apt update
-sudo apt install containerd.io -y
+# Install the containerd software, already installed from the host artifact cache in offline mode
+if [ -z "$ARTIFACTS_URL" ]; then
+  curl -fsSL https://download.docker.com/linux/ubuntu/gpg | sudo apt-key add -
+  sudo add-apt-repository "deb [arch=$ARCH] https://download.docker.com/linux/ubuntu $(lsb_release -cs) stable"
+  sudo apt update
+  sudo apt install containerd.io -y
+fi
 
 # Configure containerd and restart
 sudo mkdir -p /etc/containerd
 containerd config default | sudo tee /etc/containerd/config.toml
+# Read the registries configuration, such as the cluster local registry, from /etc/containerd/certs.d
+sudo sed -i 's|config_path = ""|config_path = "/etc/containerd/certs.d"|' /etc/containerd/config.toml
+# The pause image of the containerd defaults may not be in the host artifact cache
+if [ -n "$SANDBOX_IMAGE" ]; then
+  sudo sed -i "s|sandbox_image = .*|sandbox_image = \"$SANDBOX_IMAGE\"|" /etc/containerd/config.toml
+fi
+# Pick up the proxy drop-in of containerd
+sudo systemctl daemon-reload
 sudo systemctl restart containerd
 sudo systemctl enable containerd
 
+# Import the control plane and CNI images of the host artifact cache
+if [ -n "$ARTIFACTS_URL" ]; then
+  fetch_artifact images/images.tar && sudo ctr -n k8s.io images import images.tar && rm images.tar
+fi
+
 #  Create the config file so no more errors
 # Install and configure crictl
 export VER="v1.25.0"
 
-wget https://github.com/kubernetes-sigs/cri-tools/releases/download/$VER/crictl-$VER-linux-amd64.tar.gz
+if [ -n "$ARTIFACTS_URL" ]; then
+  fetch_artifact bin/crictl-$VER-linux-$ARCH.tar.gz
+else
+  wget https://github.com/kubernetes-sigs/cri-tools/releases/download/$VER/crictl-$VER-linux-$ARCH.tar.gz
+fi
 
-tar zxvf crictl-$VER-linux-amd64.tar.gz
+tar zxvf crictl-$VER-linux-$ARCH.tar.gz
 
 sudo mv crictl /usr/local/bin
 
@@ -86,18 +137,24 @@ runtime-endpoint=unix:///run/containerd/containerd.sock \
 --set image-endpoint=unix:///run/containerd/containerd.sock
 
 # Add Helm to make our life easier
-wget https://get.helm.sh/helm-v3.9.0-linux-amd64.tar.gz
-tar -xf helm-v3.9.0-linux-amd64.tar.gz
-sudo cp linux-amd64/helm /usr/local/bin/
+if [ -n "$ARTIFACTS_URL" ]; then
+  fetch_artifact bin/helm-v3.9.0-linux-$ARCH.tar.gz
+else
+  wget https://get.helm.sh/helm-v3.9.0-linux-$ARCH.tar.gz
+fi
+tar -xf helm-v3.9.0-linux-$ARCH.tar.gz
+sudo cp linux-$ARCH/helm /usr/local/bin/
 
 # Use Cilium as the network plugin
 # Install the CLI first
-export CILIUM_CLI_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/cilium-cli/master/stable.txt)
-export CLI_ARCH=amd64
-
-# Ensure correct architecture
-if [ "$(uname -m)" = "aarch64" ]; then CLI_ARCH=arm64; fi
-curl -L --fail --remote-name-all https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
+export CLI_ARCH=$ARCH
+if [ -n "$ARTIFACTS_URL" ]; then
+  fetch_artifact bin/cilium-linux-${CLI_ARCH}.tar.gz
+  sha256sum cilium-linux-${CLI_ARCH}.tar.gz > cilium-linux-${CLI_ARCH}.tar.gz.sha256sum
+else
+  export CILIUM_CLI_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/cilium-cli/master/stable.txt)
+  curl -L --fail --remote-name-all https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
+fi
 
 # Make sure download worked
 sha256sum --check cilium-linux-${CLI_ARCH}.tar.gz.sha256sum
@@ -0,0 +1,32 @@
+apiVersion: kubeadm.k8s.io/v1beta3
+kind: JoinConfiguration
+discovery:
+  bootstrapToken:
+    apiServerEndpoint: {{.Endpoint}}
+    token: {{.Token}}
+    caCertHashes:
+      - {{.CACertHash}}
+nodeRegistration:
+  name: {{.NodeName}}
+  kubeletExtraArgs:
+    node-ip: {{.AdvertiseAddress}}
+{{- if .NodeLabels}}
+    node-labels: {{printf "%q" .NodeLabels}}
+{{- end}}
+{{- if .Taints}}
+  taints:
+{{- range .Taints}}
+    - key: {{printf "%q" .Key}}
+{{- if .Value}}
+      value: {{printf "%q" .Value}}
+{{- end}}
+      effect: {{.Effect}}
+{{- end}}
+{{- end}}
+{{- if .ControlPlane}}
+controlPlane:
+  localAPIEndpoint:
+    advertiseAddress: {{.AdvertiseAddress}}
+    bindPort: 6443
+  certificateKey: {{.CertificateKey}}
+{{- end}}
@@ -0,0 +1,35 @@
+global_defs {
+  enable_script_security
+  script_user root
+}
+
+vrrp_script check_lb {
+  script "/usr/bin/systemctl is-active --quiet {{.Service}}"
+  interval 2
+  fall 2
+  rise 2
+}
+
+vrrp_instance {{.Cluster}}_api {
+  state {{.State}}
+  interface {{.Interface}}
+  virtual_router_id {{.RouterID}}
+  priority {{.Priority}}
+  advert_int 1
+  unicast_src_ip {{.IP}}
+  unicast_peer {
+    {{- range .Peers}}
+    {{.}}
+    {{- end}}
+  }
+  authentication {
+    auth_type PASS
+    auth_pass {{.AuthPass}}
+  }
+  virtual_ipaddress {
+    {{.VirtualIP}}/{{.PrefixLen}} dev {{.Interface}}
+  }
+  track_script {
+    check_lb
+  }
+}
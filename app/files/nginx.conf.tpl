@@ -0,0 +1,34 @@
+user www-data;
+worker_processes auto;
+pid /run/nginx.pid;
+include /etc/nginx/modules-enabled/*.conf;
+
+events {
+  worker_connections 1024;
+}
+
+stream {
+  log_format tcp '$remote_addr [$time_local] $protocol $status $bytes_sent $bytes_received $session_time "$upstream_addr"';
+  access_log /var/log/nginx/stream.log tcp;
+  error_log /var/log/nginx/error.log;
+  proxy_connect_timeout 5s;
+  proxy_timeout 50s;
+{{- range .Frontends}}
+{{- if .Servers}}
+
+  upstream {{.Name}} {
+    {{- if .NginxBalance}}
+    {{.NginxBalance}}
+    {{- end}}
+    {{- range .Servers}}
+    server {{.Address}} max_fails=3 fail_timeout=10s;
+    {{- end}}
+  }
+
+  server {
+    listen {{.Port}};
+    proxy_pass {{.Name}};
+  }
+{{- end}}
+{{- end}}
+}
@@ -0,0 +1,4 @@
+
+[plugins."io.containerd.grpc.v1.cri".registry.configs."{{.Host}}".auth]
+  username = "{{.User}}"
+  password = "{{.Password}}"
@@ -0,0 +1,5 @@
+server = "https://{{.Host}}"
+
+[host."https://{{.Host}}"]
+  capabilities = ["pull", "resolve", "push"]
+  ca = "/etc/containerd/certs.d/{{.Host}}/ca.crt"
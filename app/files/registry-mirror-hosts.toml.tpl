@@ -0,0 +1,5 @@
+server = "{{.Server}}"
+{{range .Endpoints}}
+[host."{{.}}"]
+  capabilities = ["pull", "resolve"]
+{{end -}}
@@ -0,0 +1,17 @@
+apiVersion: cilium.io/v2alpha1
+kind: CiliumLoadBalancerIPPool
+metadata:
+  name: kmpass
+spec:
+  blocks:
+  - start: {{.First}}
+    stop: {{.Last}}
+---
+apiVersion: cilium.io/v2alpha1
+kind: CiliumL2AnnouncementPolicy
+metadata:
+  name: kmpass
+spec:
+  loadBalancerIPs: true
+  interfaces:
+  - ^{{.Interface}}$
@@ -0,0 +1,19 @@
+apiVersion: metallb.io/v1beta1
+kind: IPAddressPool
+metadata:
+  name: kmpass
+  namespace: metallb-system
+spec:
+  addresses:
+  - {{.First}}-{{.Last}}
+---
+apiVersion: metallb.io/v1beta1
+kind: L2Advertisement
+metadata:
+  name: kmpass
+  namespace: metallb-system
+spec:
+  ipAddressPools:
+  - kmpass
+  interfaces:
+  - {{.Interface}}
@@ -0,0 +1,13 @@
+# Generated by kmpass for the cluster {{.Cluster}}. The VM IPs can change after a restart, run kmpass ssh-config to
+# refresh them.
+{{- range .Hosts}}
+
+Host {{.Name}}
+  HostName {{.IP}}
+  User ubuntu
+  StrictHostKeyChecking no
+  UserKnownHostsFile /dev/null
+{{- if .ProxyJump}}
+  ProxyJump {{.ProxyJump}}
+{{- end}}
+{{- end}}
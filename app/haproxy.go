@@ -0,0 +1,96 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// haproxyLB is the haproxy load balancer, the default one. The health of the servers is read from the haproxy admin
+// socket.
+type haproxyLB struct{}
+
+func (haproxyLB) Service() string {
+	return "haproxy"
+}
+
+func (haproxyLB) InstallScript() string {
+	return "apt-get install -y haproxy socat"
+}
+
+func (haproxyLB) Template() string {
+	return "app/files/haproxy.cfg.tpl"
+}
+
+func (haproxyLB) ConfigPath() string {
+	return "/etc/haproxy/haproxy.cfg"
+}
+
+func (haproxyLB) CheckCmd(path string) []string {
+	return []string{"sudo", "haproxy", "-c", "-f", path}
+}
+
+func (haproxyLB) ReloadCmd() string {
+	return "systemctl reload haproxy"
+}
+
+func (haproxyLB) Backends(lbName string) ([]LBBackend, error) {
+	stats, err := haproxyStats(lbName)
+	if err != nil {
+		return nil, err
+	}
+	var backends []LBBackend
+	for _, row := range stats {
+		if row.Server == "FRONTEND" || row.Server == "BACKEND" || row.Proxy == "stats" {
+			continue
+		}
+		backends = append(backends, LBBackend{Listener: row.Proxy, Server: row.Server, Status: row.Status,
+			Up: strings.HasPrefix(row.Status, "UP")})
+	}
+	return backends, nil
+}
+
+// haproxyStat is one line of the haproxy show stat command.
+type haproxyStat struct {
+	Proxy  string
+	Server string
+	Status string
+}
+
+// haproxyStats runs show stat on the haproxy admin socket of the LB.
+func haproxyStats(lbName string) ([]haproxyStat, error) {
+	out, err := RunCmd(lbName, []string{"sudo", "sh", "-c", "echo 'show stat' | socat stdio /run/haproxy/admin.sock"})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+	}
+	return parseHaproxyStats(out)
+}
+
+// parseHaproxyStats parses the CSV output of the haproxy show stat command.
+func parseHaproxyStats(out string) ([]haproxyStat, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(out, "# ")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrUnexpectedOutput
+	}
+	columns := make(map[string]int)
+	for i, column := range records[0] {
+		columns[column] = i
+	}
+	statusIdx, ok := columns["status"]
+	if !ok {
+		return nil, ErrUnexpectedOutput
+	}
+	var stats []haproxyStat
+	for _, record := range records[1:] {
+		if len(record) <= statusIdx {
+			continue
+		}
+		stats = append(stats, haproxyStat{Proxy: record[0], Server: record[1], Status: record[statusIdx]})
+	}
+	return stats, nil
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ingress controllers which can be deployed on the workers.
+const (
+	// IngressNginx deploys ingress-nginx as a DaemonSet with hostPort 80 and 443.
+	IngressNginx = "nginx"
+	// IngressCilium enables the Cilium ingress controller on the host network, HTTP and HTTPS on port 80.
+	IngressCilium = "cilium"
+)
+
+const (
+	// ingressNginxVersion is the ingress-nginx helm chart deployed on the workers.
+	ingressNginxVersion = "4.8.3"
+	// ingressTestHost is the host of the Ingress created to validate the ingress controller.
+	ingressTestHost = "kmpass-ingress-test.local"
+	// ingressTestTimeout is how long the validation waits for the test Ingress to answer through the LB.
+	ingressTestTimeout = 3 * time.Minute
+)
+
+// ingressTestConfig is the data of the ingress test manifest template.
+type ingressTestConfig struct {
+	Class string
+	Host  string
+}
+
+// ingressHTTPSPort returns the port the ingress controller serves HTTPS on, on the nodes: the backend port of the
+// ingress-router-443 listener of the LB. The Cilium shared listener serves HTTP and HTTPS on port 80.
+func (cluster *Cluster) ingressHTTPSPort() int {
+	if cluster.Ingress == IngressCilium {
+		return 80
+	}
+	return 443
+}
+
+// InstallIngress deploys an ingress controller serving the ingress-router listeners of the LB, which forward to the
+// workers. ingress-nginx runs on the workers only, the control nodes are tainted, with hostPort 80 and 443. The Cilium
+// Envoy listens on port 80 of every node, control nodes included, and the LB configuration is synced to forward 443
+// to it. The controller is validated end to end with ValidateIngress, and kept in the cluster state.
+func (cluster *Cluster) InstallIngress(controller string) error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	var step string
+	switch controller {
+	case IngressNginx:
+		step = fmt.Sprintf("helm upgrade --install ingress-nginx ingress-nginx --repo https://kubernetes.github.io/ingress-nginx "+
+			"--version %s --namespace ingress-nginx --create-namespace --set controller.kind=DaemonSet "+
+			"--set controller.hostPort.enabled=true --set controller.service.type=ClusterIP "+
+			"--set controller.ingressClassResource.default=true --wait --timeout 5m", ingressNginxVersion)
+	case IngressCilium:
+		// the Cilium ingress controller needs the kube-proxy replacement, which is only set by InstallCNI
+		if !cluster.KubeProxyReplacement {
+			return ErrKubeProxyReplacement
+		}
+		// on the host network, the Cilium shared listener serves HTTP and HTTPS on a single port
+		step = "cilium upgrade --reuse-values --set ingressController.enabled=true --set ingressController.default=true " +
+			"--set ingressController.loadbalancerMode=shared --set ingressController.service.type=ClusterIP " +
+			"--set ingressController.hostNetwork.enabled=true --set ingressController.hostNetwork.sharedListenerPort=80 " +
+			"--set envoy.securityContext.capabilities.keepCapNetBindService=true && " +
+			"kubectl -n kube-system rollout restart deployment/cilium-operator daemonset/cilium && cilium status --wait"
+	default:
+		return ErrIngressController
+	}
+	if out, err := RunCmd(firstCtrlName, []string{"sh", "-c", step}); err != nil {
+		Logger.Error("unable to install the ingress controller", "err", err, "output", out, "controller", controller,
+			"cluster", cluster.Name)
+		return err
+	}
+	cluster.Ingress = controller
+	if err := cluster.SaveState(); err != nil {
+		return err
+	}
+	if cluster.LBMode != LBModeKubeVIP {
+		// the backend port of the ingress-router-443 listener depends on the controller
+		if _, err := cluster.SyncLB(); err != nil {
+			return err
+		}
+	}
+	Logger.Info("ingress controller installed", "cluster", cluster.Name, "controller", controller)
+	return cluster.ValidateIngress()
+}
+
+// ingressEndpoint returns the address the ingress controller is reached at from the host: the LB, or the first
+// worker in kube-vip mode as there is no LB forwarding 80 and 443.
+func (cluster *Cluster) ingressEndpoint() string {
+	if cluster.LBMode == LBModeKubeVIP && len(cluster.CmpNodesIPs) > 0 {
+		return cluster.CmpNodesIPs[0]
+	}
+	return cluster.PublicAPIEndpoint
+}
+
+// ValidateIngress creates a test Ingress, backed by a small web server, and fetches it from the host through the LB
+// until it answers or the timeout expires. The test resources are deleted afterwards.
+func (cluster *Cluster) ValidateIngress() error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	config := ingressTestConfig{Class: cluster.Ingress, Host: ingressTestHost}
+	manifestPath, err := renderTemplate("app/files/ingress-test.yaml.tpl", "ingress-test.yaml", config)
+	if err != nil {
+		return err
+	}
+	if err := Transfer(firstCtrlName, manifestPath, "ingress-test.yaml"); err != nil {
+		return err
+	}
+	if out, err := RunCmd(firstCtrlName, []string{"kubectl", "apply", "-f", "/tmp/ingress-test.yaml"}); err != nil {
+		Logger.Error("unable to create the test ingress", "err", err, "output", out, "cluster", cluster.Name)
+		return err
+	}
+	defer func() {
+		deleteCmd := []string{"kubectl", "delete", "-f", "/tmp/ingress-test.yaml", "--wait=false"}
+		if out, err := RunCmd(firstCtrlName, deleteCmd); err != nil {
+			Logger.Warn("unable to delete the test ingress", "err", err, "output", out, "cluster", cluster.Name)
+		}
+	}()
+
+	url := fmt.Sprintf("http://%s/", cluster.ingressEndpoint())
+	deadline := time.Now().Add(ingressTestTimeout)
+	for {
+		body, err := fetchIngress(url, ingressTestHost)
+		if err == nil && strings.Contains(body, "kmpass") {
+			Logger.Info("ingress answered through the load balancer", "cluster", cluster.Name, "url", url)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			Logger.Error("test ingress did not answer", "err", err, "url", url, "host", ingressTestHost)
+			return ErrIngressUnreachable
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// fetchIngress gets url with the given Host header and returns the body if the answer is 200.
+func fetchIngress(url string, host string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Host = host
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: status %d", ErrIngressUnreachable, resp.StatusCode)
+	}
+	return string(body), nil
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -58,6 +59,10 @@ func (vm *Instance) Create() error {
 	vmCores := strconv.Itoa(vm.Cores)
 	cmdConfig := []string{"launch", vm.Image, "-n", vm.Name, "-d", vm.Disk, "-c", vmCores, "-m", vm.Memory, "--timeout", "600"}
 	if vm.CloudInitFile != "" {
+		if err := validateCloudInit(vm.CloudInitFile); err != nil {
+			Logger.Error("failed to start instance", "err", err, "name", vm.Name, "cloud-init", vm.CloudInitFile)
+			return err
+		}
 		cmdConfig = append(cmdConfig, "--cloud-init", vm.CloudInitFile)
 	}
 	cmd := exec.Command("multipass", cmdConfig...)
@@ -80,6 +85,41 @@ func (vm *Instance) Create() error {
 	return nil
 }
 
+// multipass runs a multipass subcommand on the instance and logs its output on failure.
+func (vm *Instance) multipass(args ...string) error {
+	out, err := exec.Command("multipass", args...).CombinedOutput()
+	if err != nil {
+		Logger.Error("multipass command failed", "err", err, "name", vm.Name, "cmd", args[0])
+		Logger.Debug("multipass command failed", "stdout", string(out))
+	}
+	return err
+}
+
+// Start starts a stopped instance. Starting a running instance is a no-op.
+func (vm *Instance) Start() error {
+	return vm.multipass("start", vm.Name)
+}
+
+// Stop stops a running instance. Stopping a stopped instance is a no-op.
+func (vm *Instance) Stop() error {
+	return vm.multipass("stop", vm.Name)
+}
+
+// Delete deletes and purges an instance.
+func (vm *Instance) Delete() error {
+	return vm.multipass("delete", "--purge", vm.Name)
+}
+
+// Snapshot takes a snapshot of a stopped instance. The snapshot can be restored with Restore.
+func (vm *Instance) Snapshot(name string) error {
+	return vm.multipass("snapshot", "--name", name, vm.Name)
+}
+
+// Restore restores a stopped instance to a snapshot. The current state of the instance is discarded.
+func (vm *Instance) Restore(name string) error {
+	return vm.multipass("restore", "--destructive", fmt.Sprintf("%s.%s", vm.Name, name))
+}
+
 // Transfer transfers a file to the temp folder of an Instance. It leverages multipass transfer command. dest is
 // the name of the dest file. It will appear in the VM as /tmp/dest
 func Transfer(vmName string, src string, dst string) error {
@@ -93,6 +133,19 @@ func Transfer(vmName string, src string, dst string) error {
 	return err
 }
 
+// TransferFrom copies a file from an Instance to the host. It leverages multipass transfer command. src is the path
+// of the file in the VM and dst the path on the host.
+func TransferFrom(vmName string, src string, dst string) error {
+	cmdConfig := []string{"transfer", fmt.Sprintf("%s:%s", vmName, src), dst}
+	cmd := exec.Command("multipass", cmdConfig...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		Logger.Error("failed to copy file from instance", "err", err, "name", vmName, "src", src, "dst", dst)
+		Logger.Debug("failed to copy file from instance", "stdout", string(out))
+	}
+	return err
+}
+
 // RunCmd run commands in a VM. It leverages multipass exec command. Returns the combined output (stderr + stdout) of
 // the command and an error.
 func RunCmd(vmName string, args []string) (string, error) {
@@ -151,8 +204,67 @@ func (vm *Instance) IsStopped() bool {
 	return vm.state() == "Stopped"
 }
 
+// InstanceInfo is the description of a VM as reported by multipass list.
+type InstanceInfo struct {
+	Name    string   `json:"name"`
+	State   string   `json:"state"`
+	IPv4    []string `json:"ipv4"`
+	Release string   `json:"release"`
+}
+
+// ListInstances returns all the VMs known by multipass on the host, whatever the cluster they belong to.
+// It leverages multipass list command.
+func ListInstances() ([]InstanceInfo, error) {
+	cmd := exec.Command("multipass", "list", "--format", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		List []InstanceInfo `json:"list"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		Logger.Debug("unable to decode multipass list output", "err", err, "stdout", string(out))
+		return nil, ErrUnexpectedOutput
+	}
+	return list.List, nil
+}
+
+// MultipassVersion returns the version of the multipass client installed on the host.
+func MultipassVersion() (string, error) {
+	out, err := exec.Command("multipass", "version").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return "", ErrUnexpectedOutput
+	}
+	return fields[1], nil
+}
+
 // validateMemoryFormat checks if an instance memory or disk size is valid. eg: 4G
 func validateMemoryFormat(size string) bool {
 	re := regexp.MustCompile(`^[1-9][0-9]*[KMGkmg]$`)
 	return re.MatchString(size)
 }
+
+// parseSize converts an instance memory or disk size (eg: 4G) to a number of bytes.
+func parseSize(size string) (uint64, error) {
+	if !validateMemoryFormat(size) {
+		return 0, ErrMemFormat
+	}
+	value, err := strconv.ParseUint(size[:len(size)-1], 10, 64)
+	if err != nil {
+		return 0, ErrMemFormat
+	}
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		value <<= 10
+	case "M":
+		value <<= 20
+	case "G":
+		value <<= 30
+	}
+	return value, nil
+}
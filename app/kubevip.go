@@ -0,0 +1,90 @@
+package app
+
+import "fmt"
+
+const (
+	// kubeVIPImage is the kube-vip image deployed on the control nodes.
+	kubeVIPImage = "ghcr.io/kube-vip/kube-vip:v0.6.4"
+	// kubeVIPManifest is the path of the kube-vip static pod manifest in the control nodes.
+	kubeVIPManifest = "/etc/kubernetes/manifests/kube-vip.yaml"
+)
+
+// kubeVIPConfig is the data of the kube-vip manifest template of a control node.
+type kubeVIPConfig struct {
+	Image     string
+	Interface string
+	VirtualIP string
+}
+
+// PrepareKubeVIP chooses the virtual IP advertised by kube-vip, if not set, and makes it the cluster public API
+// endpoint. It must be called once the control nodes are running, before the kubeadm configuration is generated.
+// Returns ErrVMAlreadyExist if kube-vip is already deployed on the first control node.
+func (cluster *Cluster) PrepareKubeVIP() error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	if _, err := RunCmd(firstCtrlName, []string{"test", "-f", kubeVIPManifest}); err == nil {
+		return ErrVMAlreadyExist
+	}
+	if cluster.VirtualIP == "" {
+		IP, err := (&Instance{Name: firstCtrlName}).GetIP()
+		if err != nil {
+			Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", firstCtrlName)
+			return err
+		}
+		_, prefixLen, err := vmInterface(firstCtrlName, IP)
+		if err != nil {
+			return err
+		}
+		if cluster.VirtualIP, err = chooseVirtualIP(firstCtrlName, IP, prefixLen); err != nil {
+			return err
+		}
+		Logger.Info("kube-vip virtual IP chosen", "cluster", cluster.Name, "virtual-ip", cluster.VirtualIP)
+	}
+	cluster.PublicAPIEndpoint = cluster.VirtualIP
+	return nil
+}
+
+// DeployKubeVIP renders the kube-vip manifest of a control node and installs it in the static pods directory. On the
+// first control node it must run before kubeadm init, on the others after they joined, as kube-vip needs the
+// node admin.conf.
+func (cluster *Cluster) DeployKubeVIP(vmName string) error {
+	IP, err := (&Instance{Name: vmName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", vmName)
+		return err
+	}
+	iface, _, err := vmInterface(vmName, IP)
+	if err != nil {
+		return err
+	}
+	config := kubeVIPConfig{Image: kubeVIPImage, Interface: iface, VirtualIP: cluster.VirtualIP}
+	manifestPath, err := renderTemplate("app/files/kube-vip.yaml.tpl", vmName+"-kube-vip.yaml", config)
+	if err != nil {
+		return err
+	}
+	if err := Transfer(vmName, manifestPath, "kube-vip.yaml"); err != nil {
+		return err
+	}
+	installCmd := []string{"sudo", "sh", "-c", "mkdir -p /etc/kubernetes/manifests && cp /tmp/kube-vip.yaml " +
+		kubeVIPManifest}
+	if out, err := RunCmd(vmName, installCmd); err != nil {
+		Logger.Error("unable to install kube-vip manifest", "err", err, "output", out, "instance-name", vmName)
+		return err
+	}
+	Logger.Info("kube-vip deployed", "instance-name", vmName, "virtual-ip", cluster.VirtualIP)
+	return nil
+}
+
+// vmInterface returns the network interface holding the given IP address in a VM, and its prefix length.
+func vmInterface(vmName string, IP string) (string, int, error) {
+	out, err := RunCmd(vmName, []string{"ip", "-o", "-4", "addr", "show"})
+	if err != nil {
+		Logger.Error("unable to list vm interfaces", "err", err, "instance-name", vmName)
+		return "", 0, err
+	}
+	iface, prefixLen, err := parseIPAddrShow(out, IP)
+	if err != nil {
+		Logger.Error("unable to find vm interface", "err", err, "instance-name", vmName, "ip", IP)
+		return "", 0, err
+	}
+	return iface, prefixLen, nil
+}
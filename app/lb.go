@@ -0,0 +1,481 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default load balancer settings.
+const (
+	defaultLBStatsPort = 8404
+	defaultLBStatsUser = "admin"
+	defaultLBBalance   = "roundrobin"
+)
+
+// lbBalanceAlgorithms are the balance algorithms supported for the LB backends, named after the haproxy ones. nginx
+// and Envoy use their equivalent.
+var lbBalanceAlgorithms = []string{"roundrobin", "leastconn"}
+
+// Node pools which can be targeted by the LB listeners.
+const (
+	ControlPool = "control"
+	WorkerPool  = "worker"
+)
+
+// LBListener is an extra TCP listener of the LB, declared in the cluster spec. It forwards Port on the LB to
+// BackendPort on every node of Pool, eg: a NodePort service of the cluster.
+type LBListener struct {
+	// Name of the listener in the LB configuration. Defaults to <pool>-<port>.
+	Name        string
+	Port        int
+	Pool        string
+	BackendPort int
+	// Balance is the balance algorithm of the listener. Defaults to the LB balance algorithm.
+	Balance string
+}
+
+// LBConfig holds the load balancer settings. Zero values are replaced by defaults when the configuration is rendered.
+type LBConfig struct {
+	// StatsPort is the port of the stats page, only served by haproxy. It must not collide with the listeners ports.
+	StatsPort int
+	StatsUser string
+	// StatsPassword is generated per cluster if empty, and kept in the cluster state.
+	StatsPassword string
+	// Balance is the balance algorithm of the backends, roundrobin or leastconn.
+	Balance string
+	// Listeners are the extra TCP listeners rendered next to the kube API and ingress ones.
+	Listeners []LBListener
+}
+
+// reservedLBPorts are the ports used by the LB listeners.
+var reservedLBPorts = []int{80, 443, 6443}
+
+// reservedLBNames are the names of the stats page and of the listeners kmpass renders, they cannot name an extra
+// listener.
+var reservedLBNames = []string{"stats", kubeAPIFrontend, "ingress-router-443", "ingress-router-80"}
+
+// lbListenerName matches the name of an extra listener, used as the haproxy proxy, nginx upstream and Envoy listener
+// and cluster names.
+var lbListenerName = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.]{0,62}$`)
+
+// validPort checks a TCP port number.
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// validate checks the LB settings. Zero values are valid as they are replaced by defaults. Two listeners, stats page
+// included, cannot use the same port or name, and the listeners target one of pools.
+func (config *LBConfig) validate(pools []string) error {
+	statsPort := config.StatsPort
+	if statsPort == 0 {
+		statsPort = defaultLBStatsPort
+	}
+	if !validPort(statsPort) {
+		return ErrLBPort
+	}
+	if config.Balance != "" && !slices.Contains(lbBalanceAlgorithms, config.Balance) {
+		return ErrLBBalance
+	}
+	used := append(slices.Clone(reservedLBPorts), statsPort)
+	if slices.Contains(reservedLBPorts, statsPort) {
+		return ErrLBPortCollision
+	}
+	names := slices.Clone(reservedLBNames)
+	for _, listener := range config.Listeners {
+		if !validPort(listener.Port) || !validPort(listener.BackendPort) {
+			return ErrLBPort
+		}
+		name := listener.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", listener.Pool, listener.Port)
+		}
+		if !lbListenerName.MatchString(name) || slices.Contains(names, name) {
+			Logger.Debug("invalid or already used load balancer listener name", "name", name)
+			return ErrLBListenerName
+		}
+		names = append(names, name)
+		if slices.Contains(used, listener.Port) {
+			Logger.Debug("load balancer port already used", "port", listener.Port)
+			return ErrLBPortCollision
+		}
+		used = append(used, listener.Port)
+		if !slices.Contains(pools, listener.Pool) {
+			return ErrLBPool
+		}
+		if listener.Balance != "" && !slices.Contains(lbBalanceAlgorithms, listener.Balance) {
+			return ErrLBBalance
+		}
+	}
+	return nil
+}
+
+// lbPortUsed returns true if the stats page or an extra listener of the LB uses port, which is then not available to
+// the services kmpass runs on the first LB node.
+func (cluster *Cluster) lbPortUsed(port int) bool {
+	return cluster.LB.StatsPort == port || slices.ContainsFunc(cluster.LB.Listeners, func(listener LBListener) bool {
+		return listener.Port == port
+	})
+}
+
+// setDefaults replaces the zero values of the LB settings with defaults and generates the stats password.
+func (config *LBConfig) setDefaults() error {
+	if config.StatsPort == 0 {
+		config.StatsPort = defaultLBStatsPort
+	}
+	if config.StatsUser == "" {
+		config.StatsUser = defaultLBStatsUser
+	}
+	if config.Balance == "" {
+		config.Balance = defaultLBBalance
+	}
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		if listener.Name == "" {
+			listener.Name = fmt.Sprintf("%s-%d", listener.Pool, listener.Port)
+		}
+		if listener.Balance == "" {
+			listener.Balance = config.Balance
+		}
+	}
+	if config.StatsPassword == "" {
+		password := make([]byte, 12)
+		if _, err := rand.Read(password); err != nil {
+			Logger.Error("unable to generate LB stats password", "err", err)
+			return err
+		}
+		config.StatsPassword = hex.EncodeToString(password)
+	}
+	return nil
+}
+
+// keepalivedConfig is the data of the keepalived configuration template of a LB node.
+type keepalivedConfig struct {
+	Cluster string
+	// Service is the systemd service of the load balancer, the virtual IP moves away when it is not active.
+	Service   string
+	State     string
+	Interface string
+	IP        string
+	Peers     []string
+	RouterID  int
+	Priority  int
+	AuthPass  string
+	VirtualIP string
+	PrefixLen int
+}
+
+// virtualRouterID derives the VRRP router id from the cluster name so that clusters sharing the multipass bridge do
+// not use the same one.
+func (cluster *Cluster) virtualRouterID() int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(cluster.Name))
+	return int(h.Sum32()%254) + 1
+}
+
+// vrrpAuthPass derives the VRRP password of the cluster from its bootstrap token. keepalived only uses its first 8
+// characters.
+func (cluster *Cluster) vrrpAuthPass() string {
+	sum := sha256.Sum256([]byte(cluster.Name + cluster.BootstrapToken))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// parseIPAddrShow finds the interface holding IP and its prefix length in the output of ip -o -4 addr show.
+func parseIPAddrShow(out string, IP string) (string, int, error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "inet" {
+			continue
+		}
+		addr, prefix, found := strings.Cut(fields[3], "/")
+		if !found || addr != IP {
+			continue
+		}
+		prefixLen, err := strconv.Atoi(prefix)
+		if err != nil {
+			return "", 0, ErrUnexpectedOutput
+		}
+		return fields[1], prefixLen, nil
+	}
+	return "", 0, ErrUnexpectedOutput
+}
+
+// virtualIPCandidates returns the addresses of the subnet which can be used as a virtual IP, starting from the top of
+// the subnet where the multipass DHCP server is the least likely to lease addresses. used addresses are skipped.
+func virtualIPCandidates(subnet *net.IPNet, used []string, max int) []string {
+	base := subnet.IP.To4()
+	if base == nil {
+		return nil
+	}
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << uint32(bits-ones)
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	var candidates []string
+	// skip the broadcast address
+	for offset := size - 2; offset > 0 && len(candidates) < max; offset-- {
+		n := start + offset
+		IP := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String()
+		if !containsIP(used, IP) {
+			candidates = append(candidates, IP)
+		}
+	}
+	return candidates
+}
+
+// chooseVirtualIP picks a free address of the multipass subnet of a VM, given its IP and prefix length, to be used as
+// a virtual IP. Addresses of the multipass VMs are excluded and a candidate is only kept if it does not answer to ping
+// from the VM. The address is not reserved: the multipass DHCP server leases the whole subnet and can give it to a VM
+// launched later, which then clashes with the virtual IP. Taking it from the top of the subnet makes it unlikely, not
+// impossible.
+func chooseVirtualIP(vmName string, IP string, prefixLen int) (string, error) {
+	_, subnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", IP, prefixLen))
+	if err != nil {
+		return "", ErrInvalidIPV4Address
+	}
+	instances, err := ListInstances()
+	if err != nil {
+		return "", err
+	}
+	var used []string
+	for _, instance := range instances {
+		used = append(used, instance.IPv4...)
+	}
+	for _, candidate := range virtualIPCandidates(subnet, used, 10) {
+		if _, err := RunCmd(vmName, []string{"ping", "-c", "1", "-W", "1", candidate}); err != nil {
+			return candidate, nil
+		}
+	}
+	return "", ErrNoFreeVirtualIP
+}
+
+// configureKeepalived renders and installs the keepalived configuration of both LB nodes. The first LB node is the
+// preferred owner of the virtual IP. A LB node gives the virtual IP up when its load balancer is not running.
+func (cluster *Cluster) configureKeepalived() error {
+	lbNames := cluster.LBNames()
+	if len(cluster.LBNodesIPs) != len(lbNames) {
+		return ErrInvalidIPV4Address
+	}
+	for i, lbName := range lbNames {
+		IP := cluster.LBNodesIPs[i]
+		out, err := RunCmd(lbName, []string{"ip", "-o", "-4", "addr", "show"})
+		if err != nil {
+			Logger.Error("unable to list LB interfaces", "err", err, "instance-name", lbName)
+			return err
+		}
+		iface, prefixLen, err := parseIPAddrShow(out, IP)
+		if err != nil {
+			Logger.Error("unable to find LB interface", "err", err, "instance-name", lbName, "ip", IP)
+			return err
+		}
+		if cluster.VirtualIP == "" {
+			if cluster.VirtualIP, err = chooseVirtualIP(lbName, IP, prefixLen); err != nil {
+				return err
+			}
+			Logger.Info("LB virtual IP chosen", "cluster", cluster.Name, "virtual-ip", cluster.VirtualIP)
+		}
+		config := keepalivedConfig{
+			Cluster:   strings.ReplaceAll(cluster.Name, "-", "_"),
+			Service:   cluster.LoadBalancer().Service(),
+			State:     "BACKUP",
+			Interface: iface,
+			IP:        IP,
+			RouterID:  cluster.virtualRouterID(),
+			Priority:  100 - 10*i,
+			AuthPass:  cluster.vrrpAuthPass(),
+			VirtualIP: cluster.VirtualIP,
+			PrefixLen: prefixLen,
+		}
+		if i == 0 {
+			config.State = "MASTER"
+		}
+		for _, peer := range cluster.LBNodesIPs {
+			if peer != IP {
+				config.Peers = append(config.Peers, peer)
+			}
+		}
+		confPath, err := renderTemplate("app/files/keepalived.conf.tpl", lbName+"-keepalived.conf", config)
+		if err != nil {
+			return err
+		}
+		if err := Transfer(lbName, confPath, "keepalived.conf"); err != nil {
+			return err
+		}
+		installCmd := []string{"sudo", "sh", "-c",
+			"cp /tmp/keepalived.conf /etc/keepalived/keepalived.conf && systemctl enable keepalived && systemctl restart keepalived"}
+		if out, err := RunCmd(lbName, installCmd); err != nil {
+			Logger.Error("unable to start keepalived", "err", err, "output", out, "instance-name", lbName)
+			return err
+		}
+	}
+	return nil
+}
+
+// activeLB returns the name of the LB node currently holding the virtual IP.
+func (cluster *Cluster) activeLB() (string, error) {
+	for _, lbName := range cluster.LBNames() {
+		out, err := RunCmd(lbName, []string{"ip", "-o", "-4", "addr", "show"})
+		if err != nil {
+			continue
+		}
+		if _, _, err := parseIPAddrShow(out, cluster.VirtualIP); err == nil {
+			return lbName, nil
+		}
+	}
+	return "", ErrNoActiveLB
+}
+
+// apiReachable returns true if the kube API answers ready on the given address.
+func apiReachable(address string) bool {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			// the cluster CA is not known by the host, we only check the API answers
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(fmt.Sprintf("https://%s/readyz", net.JoinHostPort(address, "6443")))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// FailoverTest stops the LB node holding the virtual IP and checks that the kube API stays reachable through the
+// virtual IP. The stopped LB node is started again before returning. Returns how long the API was unreachable.
+func (cluster *Cluster) FailoverTest(timeout time.Duration) (time.Duration, error) {
+	if !cluster.LBHighAvailability || cluster.VirtualIP == "" {
+		return 0, ErrLBNotHighlyAvailable
+	}
+	if !apiReachable(cluster.VirtualIP) {
+		return 0, ErrAPIUnreachable
+	}
+	active, err := cluster.activeLB()
+	if err != nil {
+		return 0, err
+	}
+	Logger.Info("stopping the active LB", "instance-name", active, "virtual-ip", cluster.VirtualIP)
+	activeVM := &Instance{Name: active}
+	if err := activeVM.Stop(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := activeVM.Start(); err != nil {
+			Logger.Error("unable to restart LB", "err", err, "instance-name", active)
+		}
+	}()
+	start := time.Now()
+	var downtime time.Duration
+	for !apiReachable(cluster.VirtualIP) {
+		downtime = time.Since(start)
+		if downtime > timeout {
+			return downtime, ErrAPIUnreachable
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	newActive, err := cluster.activeLB()
+	if err != nil {
+		return downtime, err
+	}
+	Logger.Info("kube API reachable after failover", "instance-name", newActive, "downtime", downtime.String())
+	return downtime, nil
+}
+
+// RefreshIPs re-reads the IP addresses of the cluster VMs from multipass. The VMs may get a new address from the
+// multipass DHCP server after a restart, and VMs can be added or replaced. The IP lists are ordered by node index.
+func (cluster *Cluster) RefreshIPs() error {
+	instances, err := ListInstances()
+	if err != nil {
+		Logger.Error("unable to list multipass instances", "err", err, "cluster", cluster.Name)
+		return err
+	}
+	current := make(map[string]string, len(instances))
+	for _, instance := range instances {
+		if instance.State == "Running" && len(instance.IPv4) > 0 {
+			current[instance.Name] = instance.IPv4[0]
+		}
+	}
+	lookup := func(names []string) []string {
+		var IPs []string
+		for _, name := range names {
+			if IP, ok := current[name]; ok {
+				IPs = append(IPs, IP)
+			}
+		}
+		return IPs
+	}
+	nodeNames := cluster.NodeNames()
+	pools := cluster.workerPools()
+	cluster.Mux.Lock()
+	defer cluster.Mux.Unlock()
+	cluster.CtrlNodesIPs = lookup(nodeNames[:cluster.CtrlNodesNumber])
+	cluster.CmpNodesIPs = lookup(nodeNames[cluster.CtrlNodesNumber:])
+	cluster.WorkerPoolsIPs = make(map[string][]string, len(pools))
+	for _, pool := range pools {
+		cluster.WorkerPoolsIPs[pool.Name] = lookup(pool.nodeNames(cluster.Name))
+	}
+	cluster.LBNodesIPs = lookup(cluster.LBNames())
+	if !cluster.LBHighAvailability && len(cluster.LBNodesIPs) > 0 && cluster.LBNodesIPs[0] != cluster.PublicAPIEndpoint {
+		Logger.Warn("LB IP changed, it does not match the cluster API endpoint anymore", "cluster", cluster.Name,
+			"endpoint", cluster.PublicAPIEndpoint, "lb-ip", cluster.LBNodesIPs[0])
+	}
+	return nil
+}
+
+// SyncLB re-reads the current node IPs, re-renders the load balancer configuration and installs it on the LB nodes
+// where it differs from the installed one. The new configuration is validated by the load balancer before it is
+// reloaded. Returns true if at least one LB node configuration changed.
+func (cluster *Cluster) SyncLB() (bool, error) {
+	if err := cluster.RefreshIPs(); err != nil {
+		return false, err
+	}
+	if err := cluster.SaveState(); err != nil {
+		return false, err
+	}
+	if cluster.LBMode == LBModeKubeVIP {
+		// kube-vip follows the control nodes by itself
+		return false, nil
+	}
+	lbConfPath, err := GenerateConfigLB(cluster)
+	if err != nil {
+		return false, err
+	}
+	lb := cluster.LoadBalancer()
+	newConfPath := "/tmp/" + lbConfigFileName(lb) + ".new"
+	changed := false
+	for _, lbName := range cluster.LBNames() {
+		if err := Transfer(lbName, lbConfPath, lbConfigFileName(lb)+".new"); err != nil {
+			return changed, err
+		}
+		// diff exits with status 0 when the files are identical
+		diff, err := RunCmd(lbName, []string{"sudo", "diff", "-u", lb.ConfigPath(), newConfPath})
+		if err == nil {
+			Logger.Debug("LB configuration is up to date", "instance-name", lbName)
+			continue
+		}
+		Logger.Info("LB configuration changed", "instance-name", lbName, "diff", diff)
+		if out, err := RunCmd(lbName, lb.CheckCmd(newConfPath)); err != nil {
+			Logger.Error("new LB configuration is invalid", "err", err, "output", out, "instance-name", lbName)
+			return changed, ErrInvalidLBConfig
+		}
+		reloadCmd := []string{"sudo", "sh", "-c",
+			fmt.Sprintf("cp %s %s && %s", newConfPath, lb.ConfigPath(), lb.ReloadCmd())}
+		if out, err := RunCmd(lbName, reloadCmd); err != nil {
+			Logger.Error("unable to reload load balancer", "err", err, "output", out, "instance-name", lbName)
+			return changed, err
+		}
+		changed = true
+		Logger.Info("LB configuration reloaded", "instance-name", lbName)
+	}
+	return changed, nil
+}
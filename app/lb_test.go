@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPAddrShow(t *testing.T) {
+	out := "1: lo    inet 127.0.0.1/8 scope host lo\\       valid_lft forever preferred_lft forever\n" +
+		"2: ens3    inet 10.175.83.220/24 brd 10.175.83.255 scope global dynamic ens3\\       valid_lft 3201sec\n"
+	tests := []struct {
+		name       string
+		IP         string
+		wantIface  string
+		wantPrefix int
+		wantErr    bool
+	}{
+		{name: "ip_found", IP: "10.175.83.220", wantIface: "ens3", wantPrefix: 24, wantErr: false},
+		{name: "ip_loopback", IP: "127.0.0.1", wantIface: "lo", wantPrefix: 8, wantErr: false},
+		{name: "ip_not_found", IP: "10.175.83.221", wantIface: "", wantPrefix: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface, prefix, err := parseIPAddrShow(out, tt.IP)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseIPAddrShow() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if iface != tt.wantIface || prefix != tt.wantPrefix {
+				t.Errorf("parseIPAddrShow() got = %v/%v, want %v/%v", iface, prefix, tt.wantIface, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestVirtualIPCandidates(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.175.83.0/24")
+	tests := []struct {
+		name string
+		used []string
+		max  int
+		want []string
+	}{
+		{name: "candidates_top_of_subnet", used: nil, max: 2, want: []string{"10.175.83.254", "10.175.83.253"}},
+		{name: "candidates_skip_used", used: []string{"10.175.83.254"}, max: 2,
+			want: []string{"10.175.83.253", "10.175.83.252"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := virtualIPCandidates(subnet, tt.used, tt.max); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("virtualIPCandidates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLBConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  LBConfig
+		wantErr bool
+	}{
+		{name: "lb_defaults", config: LBConfig{}, wantErr: false},
+		{name: "lb_good", config: LBConfig{StatsPort: 9000, Balance: "leastconn"}, wantErr: false},
+		{name: "lb_stats_port_collision", config: LBConfig{StatsPort: 80}, wantErr: true},
+		{name: "lb_stats_port_out_of_range", config: LBConfig{StatsPort: 70000}, wantErr: true},
+		{name: "lb_bad_balance", config: LBConfig{Balance: "source"}, wantErr: true},
+		{
+			name: "lb_listeners_good",
+			config: LBConfig{Listeners: []LBListener{
+				{Port: 5432, Pool: WorkerPool, BackendPort: 30432, Balance: "leastconn"},
+				{Port: 9092, Pool: WorkerPool, BackendPort: 30092},
+			}},
+			wantErr: false,
+		},
+		{
+			name:    "lb_listener_collides_with_stats",
+			config:  LBConfig{Listeners: []LBListener{{Port: 8404, Pool: WorkerPool, BackendPort: 30404}}},
+			wantErr: true,
+		},
+		{
+			name:    "lb_listener_collides_with_kube_api",
+			config:  LBConfig{Listeners: []LBListener{{Port: 6443, Pool: ControlPool, BackendPort: 6443}}},
+			wantErr: true,
+		},
+		{
+			name: "lb_listeners_collide",
+			config: LBConfig{Listeners: []LBListener{
+				{Port: 5432, Pool: WorkerPool, BackendPort: 30432},
+				{Port: 5432, Pool: ControlPool, BackendPort: 30433},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "lb_listener_reserved_name",
+			config:  LBConfig{Listeners: []LBListener{{Name: "stats", Port: 5432, Pool: WorkerPool, BackendPort: 30432}}},
+			wantErr: true,
+		},
+		{
+			name:    "lb_listener_bad_name",
+			config:  LBConfig{Listeners: []LBListener{{Name: "pg db", Port: 5432, Pool: WorkerPool, BackendPort: 30432}}},
+			wantErr: true,
+		},
+		{
+			name: "lb_listener_names_collide",
+			config: LBConfig{Listeners: []LBListener{
+				{Port: 5432, Pool: WorkerPool, BackendPort: 30432},
+				{Name: "worker-5432", Port: 5433, Pool: WorkerPool, BackendPort: 30433},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "lb_listener_bad_pool",
+			config:  LBConfig{Listeners: []LBListener{{Port: 5432, Pool: "db", BackendPort: 30432}}},
+			wantErr: true,
+		},
+		{
+			name:    "lb_listener_bad_backend_port",
+			config:  LBConfig{Listeners: []LBListener{{Port: 5432, Pool: WorkerPool}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate([]string{ControlPool, WorkerPool}); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
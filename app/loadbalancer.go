@@ -0,0 +1,192 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Load balancer modes of the kube API.
+const (
+	// LBModeHaproxy runs haproxy on dedicated LB VMs.
+	LBModeHaproxy = "haproxy"
+	// LBModeNginx runs nginx with the stream module on dedicated LB VMs.
+	LBModeNginx = "nginx"
+	// LBModeEnvoy runs Envoy on dedicated LB VMs.
+	LBModeEnvoy = "envoy"
+	// LBModeKubeVIP runs kube-vip as a static pod on the control nodes, advertising the virtual IP with ARP.
+	LBModeKubeVIP = "kube-vip"
+)
+
+// lbModes are the supported load balancer modes.
+var lbModes = []string{LBModeHaproxy, LBModeNginx, LBModeEnvoy, LBModeKubeVIP}
+
+// LoadBalancer is the software running on the LB VMs. Every implementation renders its own configuration from the
+// same listener model, built from the cluster nodes and LB settings, and knows how to install, validate, reload and
+// health check it.
+type LoadBalancer interface {
+	// Service is the systemd service running the load balancer.
+	Service() string
+	// InstallScript installs and enables the load balancer on a LB VM.
+	InstallScript() string
+	// Template is the path of the configuration template, rendered with an lbModel.
+	Template() string
+	// ConfigPath is the path of the configuration file on the LB VMs.
+	ConfigPath() string
+	// CheckCmd validates the configuration file at path.
+	CheckCmd(path string) []string
+	// ReloadCmd applies the configuration installed at ConfigPath, gracefully when the load balancer supports it.
+	ReloadCmd() string
+	// Backends returns the health of the servers of the LB listeners, as seen by the load balancer of a LB VM.
+	Backends(lbName string) ([]LBBackend, error)
+}
+
+// LBBackend is the health of a server of a LB listener.
+type LBBackend struct {
+	Listener string
+	Server   string
+	Status   string
+	Up       bool
+}
+
+// lbServer is a server of a LB listener.
+type lbServer struct {
+	Name string
+	IP   string
+	Port int
+}
+
+// Address returns the address of the server, ip:port.
+func (server lbServer) Address() string {
+	return fmt.Sprintf("%s:%d", server.IP, server.Port)
+}
+
+// lbFrontend is a TCP listener of the LB and the servers it forwards to.
+type lbFrontend struct {
+	Name    string
+	Port    int
+	Balance string
+	// HTTPSCheck is the path checked over HTTPS on the servers. The servers are only checked with a TCP connection
+	// if empty.
+	HTTPSCheck string
+	Servers    []lbServer
+}
+
+// lbModel is the data of the LB configuration templates.
+type lbModel struct {
+	Cluster   string
+	LB        LBConfig
+	Frontends []lbFrontend
+}
+
+// kubeAPIFrontend is the name of the kube API listener of the LB.
+const kubeAPIFrontend = "kube-api-6443"
+
+// lbModel builds the listeners of the LB from the cluster nodes: the kube API on the control nodes, the ingress
+// ports and the extra listeners of the LB settings. The LB settings defaults must be set.
+func (cluster *Cluster) lbModel() lbModel {
+	servers := func(prefix string, IPs []string, port int) []lbServer {
+		list := make([]lbServer, 0, len(IPs))
+		for i, IP := range IPs {
+			list = append(list, lbServer{Name: fmt.Sprintf("%s%d", prefix, i), IP: IP, Port: port})
+		}
+		return list
+	}
+	model := lbModel{
+		Cluster: cluster.Name,
+		LB:      cluster.LB,
+		Frontends: []lbFrontend{
+			{Name: kubeAPIFrontend, Port: 6443, Balance: cluster.LB.Balance, HTTPSCheck: "/readyz",
+				Servers: servers("ctrl", cluster.CtrlNodesIPs, 6443)},
+			{Name: "ingress-router-443", Port: 443, Balance: cluster.LB.Balance,
+				Servers: servers("cmp", cluster.CmpNodesIPs, cluster.ingressHTTPSPort())},
+			{Name: "ingress-router-80", Port: 80, Balance: cluster.LB.Balance,
+				Servers: servers("cmp", cluster.CmpNodesIPs, 80)},
+		},
+	}
+	for _, listener := range cluster.LB.Listeners {
+		model.Frontends = append(model.Frontends, lbFrontend{
+			Name:    listener.Name,
+			Port:    listener.Port,
+			Balance: listener.Balance,
+			Servers: servers(listener.Pool, cluster.PoolIPs(listener.Pool), listener.BackendPort),
+		})
+	}
+	return model
+}
+
+// LoadBalancer returns the load balancer implementation selected by the cluster LB mode, haproxy by default. Returns
+// nil in kube-vip mode as there is no LB VM.
+func (cluster *Cluster) LoadBalancer() LoadBalancer {
+	switch cluster.LBMode {
+	case LBModeKubeVIP:
+		return nil
+	case LBModeNginx:
+		return nginxLB{cluster: cluster}
+	case LBModeEnvoy:
+		return envoyLB{}
+	default:
+		return haproxyLB{}
+	}
+}
+
+// lbConfigFileName is the name of the rendered LB configuration, in the kmpass directory and in /tmp on the LB VMs.
+func lbConfigFileName(lb LoadBalancer) string {
+	return filepath.Base(lb.ConfigPath())
+}
+
+// kubeAPIBackendsUp returns true if the backends contain kube API servers and all of them are up.
+func kubeAPIBackendsUp(backends []LBBackend) bool {
+	found := false
+	for _, backend := range backends {
+		if backend.Listener != kubeAPIFrontend {
+			continue
+		}
+		found = true
+		if !backend.Up {
+			return false
+		}
+	}
+	return found
+}
+
+// probeBackends checks the servers of the frontends from a LB VM, for the load balancers which do not expose the
+// health of their servers. Servers with an HTTPS check must answer 200, the others must accept TCP connections.
+func probeBackends(lbName string, frontends []lbFrontend) ([]LBBackend, error) {
+	var script strings.Builder
+	for _, frontend := range frontends {
+		for _, server := range frontend.Servers {
+			probe := fmt.Sprintf("nc -z -w 2 %s %d", server.IP, server.Port)
+			if frontend.HTTPSCheck != "" {
+				probe = fmt.Sprintf("curl -ksf -m 2 -o /dev/null https://%s%s", server.Address(), frontend.HTTPSCheck)
+			}
+			fmt.Fprintf(&script, "if %s; then echo %s %s UP; else echo %[2]s %[3]s DOWN; fi; ",
+				probe, frontend.Name, server.Name)
+		}
+	}
+	if script.Len() == 0 {
+		return nil, nil
+	}
+	out, err := RunCmd(lbName, []string{"sh", "-c", script.String()})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+	}
+	return parseProbes(out)
+}
+
+// parseProbes parses the output of the probeBackends script, one "listener server status" line per server.
+func parseProbes(out string) ([]LBBackend, error) {
+	var backends []LBBackend
+	if strings.TrimSpace(out) == "" {
+		return nil, nil
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, ErrUnexpectedOutput
+		}
+		backends = append(backends, LBBackend{Listener: fields[0], Server: fields[1], Status: fields[2],
+			Up: fields[2] == "UP"})
+	}
+	return backends, nil
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestLBTemplates(t *testing.T) {
+	cluster := &Cluster{
+		Name:         "cluster100",
+		CtrlNodesIPs: []string{"10.1.1.10", "10.1.1.11", "10.1.1.12"},
+		CmpNodesIPs:  []string{"10.1.1.20"},
+		LB: LBConfig{
+			Balance:   "leastconn",
+			Listeners: []LBListener{{Port: 5432, Pool: WorkerPool, BackendPort: 30432}},
+		},
+	}
+	if err := cluster.LB.setDefaults(); err != nil {
+		t.Fatalf("setDefaults() error = %v", err)
+	}
+	for _, mode := range []string{LBModeHaproxy, LBModeNginx, LBModeEnvoy} {
+		t.Run(mode, func(t *testing.T) {
+			cluster.LBMode = mode
+			lb := cluster.LoadBalancer()
+			// templates paths are relative to the repository root
+			tpl, err := template.ParseFiles(filepath.Join("..", lb.Template()))
+			if err != nil {
+				t.Fatalf("ParseFiles() error = %v", err)
+			}
+			var out strings.Builder
+			if err := tpl.Execute(&out, cluster.lbModel()); err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			for _, want := range []string{"10.1.1.12", "6443", "5432"} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("%s configuration does not contain %q", mode, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCluster_lbModel_ingress(t *testing.T) {
+	tests := []struct {
+		name      string
+		ingress   string
+		wantHTTPS string
+	}{
+		{name: "nginx", ingress: IngressNginx, wantHTTPS: "10.1.1.20:443"},
+		{name: "cilium_shared_listener", ingress: IngressCilium, wantHTTPS: "10.1.1.20:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &Cluster{Name: "cluster100", CmpNodesIPs: []string{"10.1.1.20"}, Ingress: tt.ingress}
+			for _, frontend := range cluster.lbModel().Frontends {
+				if frontend.Name == "ingress-router-443" && frontend.Servers[0].Address() != tt.wantHTTPS {
+					t.Errorf("lbModel() ingress-router-443 server = %s, want %s", frontend.Servers[0].Address(),
+						tt.wantHTTPS)
+				}
+			}
+		})
+	}
+}
+
+func TestParseEnvoyClusters(t *testing.T) {
+	out := "kube-api-6443::default_priority::max_connections::1024\n" +
+		"kube-api-6443::10.1.1.10:6443::cx_active::2\n" +
+		"kube-api-6443::10.1.1.10:6443::health_flags::healthy\n" +
+		"kube-api-6443::10.1.1.11:6443::health_flags::/failed_active_hc\n"
+	want := []LBBackend{
+		{Listener: "kube-api-6443", Server: "10.1.1.10:6443", Status: "UP", Up: true},
+		{Listener: "kube-api-6443", Server: "10.1.1.11:6443", Status: "DOWN /failed_active_hc", Up: false},
+	}
+	if got := parseEnvoyClusters(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEnvoyClusters() got = %v, want %v", got, want)
+	}
+}
+
+func TestParseProbes(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    []LBBackend
+		wantErr bool
+	}{
+		{
+			name: "probes_good",
+			out:  "kube-api-6443 ctrl0 UP\ningress-router-80 cmp0 DOWN\n",
+			want: []LBBackend{
+				{Listener: "kube-api-6443", Server: "ctrl0", Status: "UP", Up: true},
+				{Listener: "ingress-router-80", Server: "cmp0", Status: "DOWN", Up: false},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "probes_bad_line",
+			out:     "kube-api-6443 ctrl0\n",
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProbes(tt.out)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProbes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProbes() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// LoadImageResult is the outcome of loading images on a node.
+type LoadImageResult struct {
+	Node string
+	Err  error
+}
+
+// PoolNodeNames returns the names of the nodes of a pool, control, worker for all the workers or a worker pool, or of
+// all the nodes if pool is empty.
+func (cluster *Cluster) PoolNodeNames(pool string) ([]string, error) {
+	names := cluster.NodeNames()
+	switch pool {
+	case "":
+		return names, nil
+	case ControlPool:
+		return names[:cluster.CtrlNodesNumber], nil
+	case WorkerPool:
+		return names[cluster.CtrlNodesNumber:], nil
+	default:
+		workerPool, found := cluster.workerPool(pool)
+		if !found {
+			return nil, ErrNodePool
+		}
+		return workerPool.nodeNames(cluster.Name), nil
+	}
+}
+
+// imageArchive returns the path of an image tarball to load. images is either the path of a tarball, or image names
+// which are exported from the host docker with docker save in a temporary file. The returned function removes the
+// temporary file, if any.
+func imageArchive(images []string) (string, func(), error) {
+	if len(images) == 0 {
+		return "", nil, ErrNoImage
+	}
+	if len(images) == 1 {
+		if info, err := os.Stat(images[0]); err == nil && !info.IsDir() {
+			return images[0], func() {}, nil
+		}
+	}
+	archive, err := os.CreateTemp("", "kmpass-images-*.tar")
+	if err != nil {
+		Logger.Error("unable to create the image archive", "err", err)
+		return "", nil, ErrCreateFile
+	}
+	_ = archive.Close()
+	cleanup := func() { _ = os.Remove(archive.Name()) }
+	args := append([]string{"save", "-o", archive.Name()}, images...)
+	if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		Logger.Error("unable to export the images with docker save", "err", err, "output", string(out),
+			"images", strings.Join(images, ","))
+		cleanup()
+		return "", nil, err
+	}
+	return archive.Name(), cleanup, nil
+}
+
+// LoadImage side-loads images in the containerd image store of the nodes of a pool, or of all the nodes if pool is
+// empty, so that pods can run them without a registry. images is an image tarball or image names of the host docker.
+// The archive is transferred and imported on numWorkers nodes at a time. Returns the result of every node, an error
+// is only returned if the images could not be loaded on any node.
+func (cluster *Cluster) LoadImage(images []string, pool string, numWorkers int) ([]LoadImageResult, error) {
+	nodes, err := cluster.PoolNodeNames(pool)
+	if err != nil {
+		return nil, err
+	}
+	archivePath, cleanup, err := imageArchive(images)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	results := make([]LoadImageResult, len(nodes))
+	var wg sync.WaitGroup
+	jobs := make(chan int, numWorkers)
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = LoadImageResult{Node: nodes[j], Err: loadArchive(nodes[j], archivePath)}
+			}
+		}()
+	}
+	for j := range nodes {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Err == nil {
+			return results, nil
+		}
+	}
+	return results, ErrLoadImage
+}
+
+// imagesArchiveName is the name of the image archive on the nodes. The name of the host archive is not used, it is
+// not safe to put in a shell command.
+const imagesArchiveName = "kmpass-images.tar"
+
+// loadArchive transfers an image archive to a node and imports it in the containerd namespace of kubernetes.
+func loadArchive(nodeName string, archivePath string) error {
+	if err := Transfer(nodeName, archivePath, imagesArchiveName); err != nil {
+		return err
+	}
+	remotePath := "/tmp/" + imagesArchiveName
+	out, err := RunCmd(nodeName, []string{"sudo", "sh", "-c",
+		fmt.Sprintf("ctr -n k8s.io images import %[1]s; status=$?; rm -f %[1]s; exit $status", remotePath)})
+	if err != nil {
+		Logger.Error("unable to import images", "err", err, "output", out, "instance-name", nodeName)
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out))
+	}
+	Logger.Info("images loaded", "instance-name", nodeName)
+	return nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCluster_PoolNodeNames(t *testing.T) {
+	cluster := &Cluster{Name: "app300", CtrlNodesNumber: 3, CmpNodesNumber: 2}
+	tests := []struct {
+		name    string
+		pool    string
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "all",
+			want: []string{"app300-ctrl-0", "app300-ctrl-1", "app300-ctrl-2", "app300-cmp-0", "app300-cmp-1"},
+		},
+		{
+			name: "control",
+			pool: ControlPool,
+			want: []string{"app300-ctrl-0", "app300-ctrl-1", "app300-ctrl-2"},
+		},
+		{
+			name: "worker",
+			pool: WorkerPool,
+			want: []string{"app300-cmp-0", "app300-cmp-1"},
+		},
+		{
+			name:    "unknown_pool",
+			pool:    "db",
+			wantErr: ErrNodePool,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cluster.PoolNodeNames(tt.pool)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PoolNodeNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("PoolNodeNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
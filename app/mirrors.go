@@ -0,0 +1,155 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// RegistryMirror is a list of mirrors pulled from, in order, before the upstream registry, eg: docker.io mirrored by
+// https://mirror.gcr.io.
+type RegistryMirror struct {
+	Registry  string
+	Endpoints []string
+}
+
+// pullCacheUpstream is an upstream registry cached on the LB VM, by a registry:2 proxy listening on Port.
+type pullCacheUpstream struct {
+	Registry string
+	URL      string
+	Port     int
+}
+
+// pullCacheUpstreams are the registries cached by the pull-through cache: the control plane, Cilium and most app
+// images come from them. A registry:2 proxy only caches one upstream, so each of them has its own port.
+var pullCacheUpstreams = []pullCacheUpstream{
+	{Registry: "docker.io", URL: "https://registry-1.docker.io", Port: 5001},
+	{Registry: "registry.k8s.io", URL: "https://registry.k8s.io", Port: 5002},
+	{Registry: "quay.io", URL: "https://quay.io", Port: 5003},
+	{Registry: "ghcr.io", URL: "https://ghcr.io", Port: 5004},
+}
+
+// mirrorHostsConfig is the data of the containerd hosts.toml template of a mirrored registry.
+type mirrorHostsConfig struct {
+	Registry  string
+	Server    string
+	Endpoints []string
+}
+
+// ParseRegistryMirrors parses mirrors given as a comma separated list of registry=endpoint, eg:
+// docker.io=https://mirror.gcr.io,quay.io=http://10.1.1.5:5000. A registry can be listed several times, its
+// mirrors are tried in order.
+func ParseRegistryMirrors(value string) ([]RegistryMirror, error) {
+	var mirrors []RegistryMirror
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		registry, endpoint, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, ErrRegistryMirror
+		}
+		i := slices.IndexFunc(mirrors, func(mirror RegistryMirror) bool { return mirror.Registry == registry })
+		if i < 0 {
+			mirrors = append(mirrors, RegistryMirror{Registry: registry})
+			i = len(mirrors) - 1
+		}
+		mirrors[i].Endpoints = append(mirrors[i].Endpoints, endpoint)
+	}
+	return mirrors, validateRegistryMirrors(mirrors)
+}
+
+// validateRegistryMirrors checks the mirrored registries are host names and their endpoints http(s) URLs.
+func validateRegistryMirrors(mirrors []RegistryMirror) error {
+	for _, mirror := range mirrors {
+		if mirror.Registry == "" || strings.ContainsAny(mirror.Registry, "/ ") || len(mirror.Endpoints) == 0 {
+			return ErrRegistryMirror
+		}
+		for _, endpoint := range mirror.Endpoints {
+			parsed, err := url.Parse(endpoint)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return ErrRegistryMirror
+			}
+		}
+	}
+	return nil
+}
+
+// PullCacheHost returns the name the nodes reach the pull-through cache with. It resolves to the first LB node
+// through /etc/hosts once the cache runs, until then containerd falls back to the next mirrors or the upstream.
+func (cluster *Cluster) PullCacheHost() string {
+	return fmt.Sprintf("%s-cache", cluster.Name)
+}
+
+// upstreamServer returns the URL of a registry API, docker.io is served by registry-1.docker.io.
+func upstreamServer(registry string) string {
+	for _, upstream := range pullCacheUpstreams {
+		if upstream.Registry == registry {
+			return upstream.URL
+		}
+	}
+	return "https://" + registry
+}
+
+// mirrorHosts returns the hosts.toml configuration of every mirrored registry: the pull-through cache first, when
+// enabled, then the mirrors of the cluster.
+func (cluster *Cluster) mirrorHosts() []mirrorHostsConfig {
+	var hosts []mirrorHostsConfig
+	add := func(registry string, endpoint string) {
+		i := slices.IndexFunc(hosts, func(host mirrorHostsConfig) bool { return host.Registry == registry })
+		if i < 0 {
+			hosts = append(hosts, mirrorHostsConfig{Registry: registry, Server: upstreamServer(registry)})
+			i = len(hosts) - 1
+		}
+		hosts[i].Endpoints = append(hosts[i].Endpoints, endpoint)
+	}
+	if cluster.PullCache {
+		for _, upstream := range pullCacheUpstreams {
+			add(upstream.Registry, fmt.Sprintf("http://%s:%d", cluster.PullCacheHost(), upstream.Port))
+		}
+	}
+	for _, mirror := range cluster.RegistryMirrors {
+		for _, endpoint := range mirror.Endpoints {
+			add(mirror.Registry, endpoint)
+		}
+	}
+	return hosts
+}
+
+// SetupPullCache runs a registry:2 proxy per cached upstream on the first LB node, and makes the nodes resolve the
+// cache name to it. The nodes got the cache as first mirror of these registries from cloud init.
+func (cluster *Cluster) SetupPullCache() error {
+	if cluster.LBMode == LBModeKubeVIP {
+		return ErrPullCache
+	}
+	lbName := cluster.LBName()
+	script := strings.Builder{}
+	script.WriteString("set -e; (command -v docker || apt-get install -y docker-ce) > /dev/null; ")
+	for _, upstream := range pullCacheUpstreams {
+		name := "kmpass-cache-" + strings.ReplaceAll(upstream.Registry, ".", "-")
+		fmt.Fprintf(&script, "if ! docker inspect %[1]s > /dev/null 2>&1; then "+
+			"docker run -d --name %[1]s --restart=always -p %[2]d:5000 -v /var/lib/%[1]s:/var/lib/registry "+
+			"-e REGISTRY_PROXY_REMOTEURL=%[3]s %[4]s; fi; ", name, upstream.Port, upstream.URL, registryImage)
+	}
+	if out, err := RunCmd(lbName, []string{"sudo", "sh", "-c", script.String()}); err != nil {
+		Logger.Error("unable to run the pull-through cache", "err", err, "output", out, "instance-name", lbName)
+		return err
+	}
+	IP, err := (&Instance{Name: lbName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", lbName)
+		return err
+	}
+	hostsEntry := fmt.Sprintf("sed -i '/ %[1]s$/d' /etc/hosts && echo '%[2]s %[1]s' >> /etc/hosts",
+		cluster.PullCacheHost(), IP)
+	for _, nodeName := range cluster.NodeNames() {
+		if out, err := RunCmd(nodeName, []string{"sudo", "sh", "-c", hostsEntry}); err != nil {
+			Logger.Error("unable to resolve the pull-through cache on node", "err", err, "output", out,
+				"instance-name", nodeName)
+			return err
+		}
+	}
+	Logger.Info("pull-through cache ready", "instance-name", lbName, "cache", cluster.PullCacheHost())
+	return nil
+}
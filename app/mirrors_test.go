@@ -0,0 +1,81 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRegistryMirrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []RegistryMirror
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "several_mirrors",
+			value: "docker.io=https://mirror.gcr.io, quay.io=http://10.1.1.5:5000,docker.io=http://10.1.1.5:5001",
+			want: []RegistryMirror{
+				{Registry: "docker.io", Endpoints: []string{"https://mirror.gcr.io", "http://10.1.1.5:5001"}},
+				{Registry: "quay.io", Endpoints: []string{"http://10.1.1.5:5000"}},
+			},
+		},
+		{
+			name:    "missing_endpoint",
+			value:   "docker.io",
+			wantErr: true,
+		},
+		{
+			name:    "bad_scheme",
+			value:   "docker.io=mirror.gcr.io",
+			wantErr: true,
+		},
+		{
+			name:    "bad_registry",
+			value:   "docker.io/library=https://mirror.gcr.io",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRegistryMirrors(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRegistryMirrors() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRegistryMirrors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCluster_mirrorHosts(t *testing.T) {
+	cluster := &Cluster{
+		Name:      "app300",
+		PullCache: true,
+		RegistryMirrors: []RegistryMirror{
+			{Registry: "docker.io", Endpoints: []string{"https://mirror.gcr.io"}},
+			{Registry: "nvcr.io", Endpoints: []string{"http://10.1.1.5:5000"}},
+		},
+	}
+	hosts := cluster.mirrorHosts()
+	if len(hosts) != len(pullCacheUpstreams)+1 {
+		t.Fatalf("mirrorHosts() returned %d registries, want %d", len(hosts), len(pullCacheUpstreams)+1)
+	}
+	docker := mirrorHostsConfig{
+		Registry:  "docker.io",
+		Server:    "https://registry-1.docker.io",
+		Endpoints: []string{"http://app300-cache:5001", "https://mirror.gcr.io"},
+	}
+	if !reflect.DeepEqual(hosts[0], docker) {
+		t.Errorf("mirrorHosts()[0] = %v, want %v", hosts[0], docker)
+	}
+	nvcr := mirrorHostsConfig{Registry: "nvcr.io", Server: "https://nvcr.io", Endpoints: []string{"http://10.1.1.5:5000"}}
+	if !reflect.DeepEqual(hosts[len(hosts)-1], nvcr) {
+		t.Errorf("mirrorHosts()[last] = %v, want %v", hosts[len(hosts)-1], nvcr)
+	}
+}
@@ -0,0 +1,44 @@
+package app
+
+// nginxLB is the nginx load balancer, using the stream module. nginx open source only marks servers down passively,
+// when connections fail, so the health of the servers is probed from the LB VM.
+type nginxLB struct {
+	cluster *Cluster
+}
+
+func (nginxLB) Service() string {
+	return "nginx"
+}
+
+func (nginxLB) InstallScript() string {
+	return "apt-get install -y nginx libnginx-mod-stream netcat-openbsd curl"
+}
+
+func (nginxLB) Template() string {
+	return "app/files/nginx.conf.tpl"
+}
+
+func (nginxLB) ConfigPath() string {
+	return "/etc/nginx/nginx.conf"
+}
+
+func (nginxLB) CheckCmd(path string) []string {
+	return []string{"sudo", "nginx", "-t", "-c", path}
+}
+
+func (nginxLB) ReloadCmd() string {
+	return "systemctl reload nginx"
+}
+
+func (lb nginxLB) Backends(lbName string) ([]LBBackend, error) {
+	return probeBackends(lbName, lb.cluster.lbModel().Frontends)
+}
+
+// NginxBalance returns the nginx upstream balancing directive of the frontend, empty for round-robin which is the
+// nginx default.
+func (frontend lbFrontend) NginxBalance() string {
+	if frontend.Balance == "leastconn" {
+		return "least_conn;"
+	}
+	return ""
+}
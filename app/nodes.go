@@ -0,0 +1,300 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// controlPlaneTaint is the taint kubeadm sets on the control nodes, kept when the control pool has extra taints.
+var controlPlaneTaint = NodeTaint{Key: "node-role.kubernetes.io/control-plane", Effect: "NoSchedule"}
+
+// taintEffects are the effects of a taint accepted by kubernetes.
+var taintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// labelName matches the name of a label key and a label value, at most 63 characters.
+var labelName = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`)
+
+// labelPrefix matches the DNS subdomain prefix of a label key, eg: example.com in example.com/disk.
+var labelPrefix = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// kubeletLabels are the labels of the kubernetes.io and k8s.io namespaces a kubelet may set on its node, the others
+// are rejected by the NodeRestriction admission plugin.
+var kubeletLabels = []string{"kubernetes.io/hostname", "kubernetes.io/arch", "kubernetes.io/os",
+	"beta.kubernetes.io/instance-type", "node.kubernetes.io/instance-type", "topology.kubernetes.io/region",
+	"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/region", "failure-domain.beta.kubernetes.io/zone"}
+
+// NodeTaint is a taint set on the nodes of a pool when they join, eg: dedicated=gpu:NoSchedule.
+type NodeTaint struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+// String returns the taint as written by kubectl taint, eg: dedicated=gpu:NoSchedule.
+func (taint NodeTaint) String() string {
+	if taint.Value == "" {
+		return taint.Key + ":" + taint.Effect
+	}
+	return fmt.Sprintf("%s=%s:%s", taint.Key, taint.Value, taint.Effect)
+}
+
+// NodeStatus is the state of a node of the cluster, and the labels and taints of its pool it does not have.
+type NodeStatus struct {
+	Name   string
+	Pool   string
+	Ready  bool
+	Labels map[string]string
+	Taints []NodeTaint
+	// MissingLabels and MissingTaints are set in the cluster spec but not on the node.
+	MissingLabels []string
+	MissingTaints []string
+}
+
+// joinConfig is the data of the kubeadm JoinConfiguration template.
+type joinConfig struct {
+	Endpoint         string
+	Token            string
+	CACertHash       string
+	NodeName         string
+	AdvertiseAddress string
+	ControlPlane     bool
+	CertificateKey   string
+	NodeLabels       string
+	Taints           []NodeTaint
+}
+
+// kubeNodeList is the part of kubectl get nodes -o json read by NodesStatus.
+type kubeNodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name   string
+			Labels map[string]string
+		}
+		Spec struct {
+			Taints []NodeTaint
+		}
+		Status struct {
+			Conditions []struct {
+				Type   string
+				Status string
+			}
+		}
+	}
+}
+
+// validateLabelKey checks a label or taint key is a qualified name, eg: disk or example.com/disk.
+func validateLabelKey(key string) bool {
+	prefix, name, found := strings.Cut(key, "/")
+	if !found {
+		prefix, name = "", key
+	} else if prefix == "" || len(prefix) > 253 || !labelPrefix.MatchString(prefix) {
+		return false
+	}
+	return len(name) <= 63 && labelName.MatchString(name)
+}
+
+// validateLabelValue checks a label or taint value, which can be empty.
+func validateLabelValue(value string) bool {
+	return value == "" || (len(value) <= 63 && labelName.MatchString(value))
+}
+
+// kubeletCanSet returns false for the labels of the kubernetes.io and k8s.io namespaces a kubelet cannot set on its
+// node, eg: node-role.kubernetes.io/worker. They must be set with kubectl once the node joined.
+func kubeletCanSet(key string) bool {
+	prefix, _, found := strings.Cut(key, "/")
+	if !found {
+		return true
+	}
+	restricted := func(domain string) bool { return prefix == domain || strings.HasSuffix(prefix, "."+domain) }
+	if !restricted("kubernetes.io") && !restricted("k8s.io") {
+		return true
+	}
+	if prefix == "kubelet.kubernetes.io" || prefix == "node.kubernetes.io" ||
+		strings.HasSuffix(prefix, ".kubelet.kubernetes.io") || strings.HasSuffix(prefix, ".node.kubernetes.io") {
+		return true
+	}
+	return slices.Contains(kubeletLabels, key)
+}
+
+// validateNodeLabels checks the labels of a node pool can be set by the kubelet.
+func validateNodeLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !validateLabelKey(key) || !validateLabelValue(value) || !kubeletCanSet(key) {
+			Logger.Debug("invalid node label", "key", key, "value", value)
+			return ErrNodeLabel
+		}
+	}
+	return nil
+}
+
+// validateNodeTaints checks the taints of a node pool.
+func validateNodeTaints(taints []NodeTaint) error {
+	for _, taint := range taints {
+		if !validateLabelKey(taint.Key) || !validateLabelValue(taint.Value) ||
+			!slices.Contains(taintEffects, taint.Effect) {
+			Logger.Debug("invalid node taint", "taint", taint.String())
+			return ErrNodeTaint
+		}
+	}
+	return nil
+}
+
+// poolLabels returns the labels of the nodes of a pool, control or a worker pool.
+func (cluster *Cluster) poolLabels(pool string) map[string]string {
+	if pool == ControlPool {
+		return cluster.CtrlNodesLabels
+	}
+	workerPool, _ := cluster.workerPool(pool)
+	return workerPool.Labels
+}
+
+// PoolNodeLabels returns the labels of the nodes of a pool as the node-labels kubelet argument, eg: disk=ssd,zone=a.
+func (cluster *Cluster) PoolNodeLabels(pool string) string {
+	labels := cluster.poolLabels(pool)
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// PoolTaints returns the taints of the nodes of a pool, control or a worker pool. The control nodes keep the kubeadm
+// control-plane taint.
+func (cluster *Cluster) PoolTaints(pool string) []NodeTaint {
+	if pool == ControlPool {
+		return append([]NodeTaint{controlPlaneTaint}, cluster.CtrlNodesTaints...)
+	}
+	workerPool, _ := cluster.workerPool(pool)
+	return workerPool.Taints
+}
+
+// nodePool returns the pool of a node from its name, <cluster>-<pool>-N: control or the name of a worker pool.
+func (cluster *Cluster) nodePool(nodeName string) string {
+	if strings.HasPrefix(nodeName, cluster.Name+"-ctrl-") {
+		return ControlPool
+	}
+	for _, pool := range cluster.workerPools() {
+		index, found := strings.CutPrefix(nodeName, cluster.Name+"-"+pool.Name+"-")
+		if found && index != "" && strings.Trim(index, "0123456789") == "" {
+			return pool.Name
+		}
+	}
+	return defaultWorkerPool
+}
+
+// GenerateConfigJoin generates the kubeadm JoinConfiguration of a node, with its name and IP address and the labels
+// and taints of its pool. The control nodes join as control plane nodes advertising their own IP address. Returns the
+// path of the configuration, which holds the bootstrap token and the certificate key: they are not passed as kubeadm
+// arguments, visible in the process list and in the logged errors. The configuration is written in the cluster
+// directory, only readable by the user, and is removed by JoinNode once used.
+func (cluster *Cluster) GenerateConfigJoin(nodeName string) (string, error) {
+	IP, err := (&Instance{Name: nodeName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to get node IP address", "err", err, "instance-name", nodeName)
+		return "", err
+	}
+	certHash, err := cluster.GetCertHash()
+	if err != nil {
+		Logger.Error("unable to get cluster certificate hash", "err", err, "cluster", cluster.Name)
+		return "", err
+	}
+	pool := cluster.nodePool(nodeName)
+	config := joinConfig{
+		Endpoint:         cluster.PublicAPIEndpoint + ":6443",
+		Token:            cluster.BootstrapToken,
+		CACertHash:       strings.TrimSpace(certHash),
+		NodeName:         nodeName,
+		AdvertiseAddress: IP,
+		ControlPlane:     pool == ControlPool,
+		NodeLabels:       cluster.PoolNodeLabels(pool),
+		Taints:           cluster.PoolTaints(pool),
+	}
+	if config.ControlPlane {
+		config.CertificateKey = cluster.KubernetesCertKey
+	}
+	joinConfPath, err := renderSecretTemplate("app/files/join.yaml.tpl", cluster.Name, "join-"+nodeName+".yaml", config)
+	if err != nil {
+		Logger.Error("unable to generate kubeadm join config file", "err", err, "instance-name", nodeName)
+		return "", err
+	}
+	return joinConfPath, nil
+}
+
+// JoinNode joins a node to the cluster with its JoinConfiguration. The configuration is removed from the host and the
+// node once joined.
+func (cluster *Cluster) JoinNode(nodeName string) error {
+	joinConfPath, err := cluster.GenerateConfigJoin(nodeName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(joinConfPath); err != nil {
+			Logger.Warn("unable to remove the kubeadm join config file", "err", err, "path", joinConfPath)
+		}
+	}()
+	if err := Transfer(nodeName, joinConfPath, "join.yaml"); err != nil {
+		return err
+	}
+	out, err := RunCmd(nodeName, []string{"sudo", "kubeadm", "join", "--config", "/tmp/join.yaml"})
+	if _, rmErr := RunCmd(nodeName, []string{"rm", "-f", "/tmp/join.yaml"}); rmErr != nil {
+		Logger.Warn("unable to remove the kubeadm join config file", "err", rmErr, "instance-name", nodeName)
+	}
+	if err != nil {
+		Logger.Error("kubeadm join command failed", "err", err, "instance-name", nodeName)
+		Logger.Debug("kubeadm join command failed", "output", out)
+		return err
+	}
+	return nil
+}
+
+// parseNodesStatus reads the output of kubectl get nodes -o json, and checks every node against the labels and taints
+// of its pool.
+func (cluster *Cluster) parseNodesStatus(out []byte) ([]NodeStatus, error) {
+	var nodes kubeNodeList
+	if err := json.Unmarshal(out, &nodes); err != nil {
+		Logger.Error("unable to decode the nodes", "err", err, "cluster", cluster.Name)
+		return nil, err
+	}
+	statuses := make([]NodeStatus, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		status := NodeStatus{
+			Name:   node.Metadata.Name,
+			Pool:   cluster.nodePool(node.Metadata.Name),
+			Labels: node.Metadata.Labels,
+			Taints: node.Spec.Taints,
+		}
+		for _, condition := range node.Status.Conditions {
+			status.Ready = status.Ready || (condition.Type == "Ready" && condition.Status == "True")
+		}
+		for key, value := range cluster.poolLabels(status.Pool) {
+			if current, found := status.Labels[key]; !found || current != value {
+				status.MissingLabels = append(status.MissingLabels, key+"="+value)
+			}
+		}
+		sort.Strings(status.MissingLabels)
+		for _, taint := range cluster.PoolTaints(status.Pool) {
+			if !slices.Contains(status.Taints, taint) {
+				status.MissingTaints = append(status.MissingTaints, taint.String())
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// NodesStatus returns the state of the nodes of the cluster, read from the first control node.
+func (cluster *Cluster) NodesStatus() ([]NodeStatus, error) {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	out, err := RunCmd(firstCtrlName, []string{"kubectl", "get", "nodes", "-o", "json"})
+	if err != nil {
+		Logger.Error("unable to get the nodes", "err", err, "output", out, "cluster", cluster.Name)
+		return nil, err
+	}
+	return cluster.parseNodesStatus([]byte(out))
+}
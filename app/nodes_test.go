@@ -0,0 +1,92 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidateNodeLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: "no_labels"},
+		{name: "simple", labels: map[string]string{"disk": "ssd", "example.com/team": "infra"}},
+		{name: "empty_value", labels: map[string]string{"gpu": ""}},
+		{name: "allowed_kubernetes_label", labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}},
+		{name: "kubelet_namespace", labels: map[string]string{"node.kubernetes.io/pool": "big"}},
+		{name: "node_role", labels: map[string]string{"node-role.kubernetes.io/worker": ""}, wantErr: true},
+		{name: "invalid_value", labels: map[string]string{"disk": "fast ssd"}, wantErr: true},
+		{name: "invalid_prefix", labels: map[string]string{"Example.com/team": "infra"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateNodeLabels(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("validateNodeLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNodeTaints(t *testing.T) {
+	tests := []struct {
+		name    string
+		taints  []NodeTaint
+		wantErr bool
+	}{
+		{name: "with_value", taints: []NodeTaint{{Key: "dedicated", Value: "gpu", Effect: "NoSchedule"}}},
+		{name: "without_value", taints: []NodeTaint{{Key: "example.com/spot", Effect: "PreferNoSchedule"}}},
+		{name: "invalid_effect", taints: []NodeTaint{{Key: "dedicated", Effect: "NoRun"}}, wantErr: true},
+		{name: "no_key", taints: []NodeTaint{{Value: "gpu", Effect: "NoExecute"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateNodeTaints(tt.taints); (err != nil) != tt.wantErr {
+				t.Errorf("validateNodeTaints() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCluster_parseNodesStatus(t *testing.T) {
+	cluster := &Cluster{
+		Name:            "app300",
+		CmpNodesNumber:  1,
+		CtrlNodesLabels: map[string]string{"zone": "a"},
+		CmpNodesLabels:  map[string]string{"disk": "ssd", "zone": "b"},
+		CmpNodesTaints:  []NodeTaint{{Key: "dedicated", Value: "db", Effect: "NoSchedule"}},
+		WorkerPools:     []NodePool{{Name: "big", Number: 1, Labels: map[string]string{"size": "big"}}},
+	}
+	if got := cluster.PoolNodeLabels(defaultWorkerPool); got != "disk=ssd,zone=b" {
+		t.Errorf("PoolNodeLabels() = %s, want disk=ssd,zone=b", got)
+	}
+	out := `{"items": [
+	{"metadata": {"name": "app300-ctrl-0", "labels": {"zone": "a"}},
+	 "spec": {"taints": [{"key": "node-role.kubernetes.io/control-plane", "effect": "NoSchedule"}]},
+	 "status": {"conditions": [{"type": "Ready", "status": "True"}]}},
+	{"metadata": {"name": "app300-cmp-0", "labels": {"disk": "ssd", "zone": "a"}},
+	 "spec": {},
+	 "status": {"conditions": [{"type": "Ready", "status": "False"}]}},
+	{"metadata": {"name": "app300-big-0", "labels": {"size": "big"}},
+	 "status": {"conditions": [{"type": "Ready", "status": "True"}]}}
+	]}`
+	nodes, err := cluster.parseNodesStatus([]byte(out))
+	if err != nil {
+		t.Fatalf("parseNodesStatus() error = %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("parseNodesStatus() = %v, want 3 nodes", nodes)
+	}
+	ctrl, cmp, big := nodes[0], nodes[1], nodes[2]
+	if ctrl.Pool != ControlPool || !ctrl.Ready || len(ctrl.MissingLabels) > 0 || len(ctrl.MissingTaints) > 0 {
+		t.Errorf("parseNodesStatus() control node = %+v", ctrl)
+	}
+	if cmp.Pool != defaultWorkerPool || cmp.Ready || !slices.Equal(cmp.MissingLabels, []string{"zone=b"}) ||
+		!slices.Equal(cmp.MissingTaints, []string{"dedicated=db:NoSchedule"}) {
+		t.Errorf("parseNodesStatus() compute node = %+v", cmp)
+	}
+	if big.Pool != "big" || len(big.MissingLabels) > 0 || len(big.MissingTaints) > 0 {
+		t.Errorf("parseNodesStatus() big pool node = %+v", big)
+	}
+}
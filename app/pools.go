@@ -0,0 +1,283 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// defaultWorkerPool is the name of the worker pool described by the CmpNodes fields of the cluster. Its nodes are
+// named <cluster>-cmp-N.
+const defaultWorkerPool = "cmp"
+
+// reservedPoolNames cannot name a worker pool: they name the default pool, the control nodes and the support VMs,
+// or target all the workers.
+var reservedPoolNames = []string{defaultWorkerPool, "ctrl", ControlPool, WorkerPool, "nfs", "registry"}
+
+// reservedPoolPrefix cannot start the name of a worker pool, it starts the names of the LB VMs.
+const reservedPoolPrefix = "lb"
+
+// poolNameFormat matches the name of a worker pool, part of the names of its VMs and kubernetes nodes.
+var poolNameFormat = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// NodePool is a named group of worker nodes with the same size, image, labels and taints, eg: small with 2 nodes of
+// 2G and big with 1 node of 8G. Its nodes are named <cluster>-<pool>-N.
+type NodePool struct {
+	Name   string
+	Number int
+	// Cores, Memory, DiskSize and Image default to the ones of the CmpNodes fields and of the cluster if empty.
+	Cores    int
+	Memory   string
+	DiskSize string
+	Image    string
+	// Labels and Taints are set on the nodes of the pool when they join.
+	Labels map[string]string
+	Taints []NodeTaint
+}
+
+// nodeName returns the name of the node i of the pool.
+func (pool NodePool) nodeName(cluster string, i int) string {
+	return fmt.Sprintf("%s-%s-%d", cluster, pool.Name, i)
+}
+
+// nodeNames returns the names of the nodes of the pool.
+func (pool NodePool) nodeNames(cluster string) []string {
+	names := make([]string, 0, pool.Number)
+	for i := 0; i < pool.Number; i++ {
+		names = append(names, pool.nodeName(cluster, i))
+	}
+	return names
+}
+
+// workerPools returns the worker pools of the cluster, the default pool first, with their defaults set.
+func (cluster *Cluster) workerPools() []NodePool {
+	pools := make([]NodePool, 0, len(cluster.WorkerPools)+1)
+	if cluster.CmpNodesNumber > 0 {
+		pools = append(pools, NodePool{
+			Name:     defaultWorkerPool,
+			Number:   cluster.CmpNodesNumber,
+			Cores:    cluster.CmpNodesCores,
+			Memory:   cluster.CmpNodesMemory,
+			DiskSize: cluster.CmpNodesDiskSize,
+			Image:    cluster.Image,
+			Labels:   cluster.CmpNodesLabels,
+			Taints:   cluster.CmpNodesTaints,
+		})
+	}
+	for _, pool := range cluster.WorkerPools {
+		if pool.Cores == 0 {
+			pool.Cores = cluster.CmpNodesCores
+		}
+		if pool.Memory == "" {
+			pool.Memory = cluster.CmpNodesMemory
+		}
+		if pool.DiskSize == "" {
+			pool.DiskSize = cluster.CmpNodesDiskSize
+		}
+		if pool.Image == "" {
+			pool.Image = cluster.Image
+		}
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// workerPool returns the worker pool named name.
+func (cluster *Cluster) workerPool(name string) (NodePool, bool) {
+	for _, pool := range cluster.workerPools() {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return NodePool{}, false
+}
+
+// WorkerPoolNames returns the names of the worker pools of the cluster, the default pool, cmp, first.
+func (cluster *Cluster) WorkerPoolNames() []string {
+	var names []string
+	for _, pool := range cluster.workerPools() {
+		names = append(names, pool.Name)
+	}
+	return names
+}
+
+// workerNodesNumber returns the number of worker nodes of all the pools.
+func (cluster *Cluster) workerNodesNumber() int {
+	number := 0
+	for _, pool := range cluster.workerPools() {
+		number += pool.Number
+	}
+	return number
+}
+
+// workerNodeNames returns the names of the worker nodes, pool by pool.
+func (cluster *Cluster) workerNodeNames() []string {
+	var names []string
+	for _, pool := range cluster.workerPools() {
+		names = append(names, pool.nodeNames(cluster.Name)...)
+	}
+	return names
+}
+
+// lbPools returns the pools the LB listeners can target: the control nodes, all the workers or a worker pool.
+func (cluster *Cluster) lbPools() []string {
+	pools := []string{ControlPool, WorkerPool}
+	for _, pool := range cluster.workerPools() {
+		pools = append(pools, pool.Name)
+	}
+	return pools
+}
+
+// validateWorkerPools checks the names, sizes, labels and taints of the named worker pools.
+func (cluster *Cluster) validateWorkerPools() error {
+	var names []string
+	for _, pool := range cluster.WorkerPools {
+		if !poolNameFormat.MatchString(pool.Name) || slices.Contains(reservedPoolNames, pool.Name) ||
+			strings.HasPrefix(pool.Name, reservedPoolPrefix) ||
+			slices.Contains(names, pool.Name) {
+			Logger.Debug("invalid worker pool name", "pool", pool.Name)
+			return ErrWorkerPool
+		}
+		names = append(names, pool.Name)
+		if pool.Number < 0 || pool.Cores < 0 {
+			Logger.Debug("invalid worker pool size", "pool", pool.Name)
+			return ErrWorkerPool
+		}
+		if (pool.Memory != "" && !validateMemoryFormat(pool.Memory)) ||
+			(pool.DiskSize != "" && !validateMemoryFormat(pool.DiskSize)) {
+			return ErrMemFormat
+		}
+		if err := validateNodeLabels(pool.Labels); err != nil {
+			return err
+		}
+		if err := validateNodeTaints(pool.Taints); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWorkerIP adds the IP address of a newly created worker node to the IPs of its pool and of all the workers.
+func (cluster *Cluster) addWorkerIP(pool string, IP string) {
+	cluster.AddComputeIP(IP)
+	cluster.Mux.Lock()
+	defer cluster.Mux.Unlock()
+	if cluster.WorkerPoolsIPs == nil {
+		cluster.WorkerPoolsIPs = make(map[string][]string)
+	}
+	if !containsIP(cluster.WorkerPoolsIPs[pool], IP) {
+		cluster.WorkerPoolsIPs[pool] = append(cluster.WorkerPoolsIPs[pool], IP)
+	}
+}
+
+// setPoolNumber changes the number of nodes of a worker pool.
+func (cluster *Cluster) setPoolNumber(name string, number int) {
+	if name == defaultWorkerPool {
+		cluster.CmpNodesNumber = number
+		return
+	}
+	for i := range cluster.WorkerPools {
+		if cluster.WorkerPools[i].Name == name {
+			cluster.WorkerPools[i].Number = number
+		}
+	}
+}
+
+// removeNode drains a worker node, removes it from the cluster and deletes its VM.
+func (cluster *Cluster) removeNode(nodeName string) error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	drainCmd := []string{"kubectl", "drain", nodeName, "--ignore-daemonsets", "--delete-emptydir-data", "--force",
+		"--timeout=300s"}
+	if out, err := RunCmd(firstCtrlName, drainCmd); err != nil && !strings.Contains(out, "NotFound") {
+		Logger.Error("unable to drain node", "err", err, "output", out, "instance-name", nodeName)
+		return err
+	}
+	deleteCmd := []string{"kubectl", "delete", "node", nodeName, "--ignore-not-found"}
+	if out, err := RunCmd(firstCtrlName, deleteCmd); err != nil {
+		Logger.Error("unable to delete node", "err", err, "output", out, "instance-name", nodeName)
+		return err
+	}
+	vm := &Instance{Name: nodeName}
+	if vm.Exist() {
+		if err := vm.Delete(); err != nil {
+			return err
+		}
+	}
+	Logger.Info("node removed", "instance-name", nodeName, "cluster", cluster.Name)
+	return nil
+}
+
+// ScalePool changes the number of nodes of a worker pool. New nodes are created numWorkers at a time and joined with
+// the labels and taints of the pool, removed nodes are drained and deleted, highest index first. The load balancer
+// backends follow the new nodes. Must be run from the kmpass source directory, like the cluster creation, as the
+// nodes cloud init file is generated again.
+func (cluster *Cluster) ScalePool(name string, number int, numWorkers int) error {
+	pool, found := cluster.workerPool(name)
+	if !found {
+		return ErrNodePool
+	}
+	if number < 0 || cluster.workerNodesNumber()-pool.Number+number < minCmpNodes {
+		return ErrMinComputeNodes
+	}
+	cluster.setPoolNumber(name, number)
+	if number > pool.Number {
+		if cluster.ArtifactsURL != "" {
+			if err := cluster.ServeArtifacts(cluster.ArtifactsVersion, strings.TrimPrefix(cluster.ArtifactsURL,
+				"http://")); err != nil {
+				return err
+			}
+		}
+		cloudInitPath, err := GenerateConfigCloudInit(cluster)
+		if err != nil {
+			return err
+		}
+		scaled, _ := cluster.workerPool(name)
+		var vms []*Instance
+		for i := pool.Number; i < number; i++ {
+			vm, err := NewInstanceConfig(scaled.Cores, scaled.Memory, scaled.DiskSize, scaled.Image,
+				scaled.nodeName(cluster.Name, i), cluster.poolCloudInit(cloudInitPath, name))
+			if err != nil {
+				return err
+			}
+			vms = append(vms, vm)
+		}
+		cluster.createVMs(vms, numWorkers)
+		// the bootstrap token of the cluster creation expires after a day
+		firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+		tokenCmd := []string{"sudo", "kubeadm", "token", "create", cluster.BootstrapToken, "--ttl", "24h"}
+		if out, err := RunCmd(firstCtrlName, tokenCmd); err != nil && !strings.Contains(out, "already exists") {
+			Logger.Error("unable to create the bootstrap token", "err", err, "cluster", cluster.Name)
+			return err
+		}
+		for _, vm := range vms {
+			if err := cluster.JoinNode(vm.Name); err != nil {
+				return err
+			}
+			if cluster.Registry != "" {
+				if err := cluster.trustRegistry(vm.Name); err != nil {
+					Logger.Warn("registry not trusted by the new node", "err", err, "instance-name", vm.Name)
+				}
+			}
+		}
+		if cluster.PullCache {
+			if err := cluster.SetupPullCache(); err != nil {
+				Logger.Warn("pull-through cache not resolved by the new nodes", "err", err, "cluster", cluster.Name)
+			}
+		}
+	}
+	for i := pool.Number - 1; i >= number; i-- {
+		if err := cluster.removeNode(pool.nodeName(cluster.Name, i)); err != nil {
+			// keep the nodes which could not be removed
+			cluster.setPoolNumber(name, i+1)
+			_ = cluster.SaveState()
+			return err
+		}
+	}
+	// SyncLB refreshes the node IPs and saves the state
+	if _, err := cluster.SyncLB(); err != nil {
+		return err
+	}
+	Logger.Info("worker pool scaled", "pool", name, "nodes", number, "cluster", cluster.Name)
+	return nil
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCluster_validateWorkerPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		pools   []NodePool
+		wantErr bool
+	}{
+		{name: "no_pools"},
+		{name: "valid", pools: []NodePool{{Name: "small", Number: 2, Memory: "2G"}, {Name: "big", Number: 1}}},
+		{name: "reserved_name", pools: []NodePool{{Name: "cmp", Number: 1}}, wantErr: true},
+		{name: "reserved_support_name", pools: []NodePool{{Name: "registry", Number: 1}}, wantErr: true},
+		{name: "reserved_lb_prefix", pools: []NodePool{{Name: "lbx", Number: 1}}, wantErr: true},
+		{name: "invalid_name", pools: []NodePool{{Name: "Big_Pool", Number: 1}}, wantErr: true},
+		{name: "duplicated_name", pools: []NodePool{{Name: "big"}, {Name: "big"}}, wantErr: true},
+		{name: "negative_number", pools: []NodePool{{Name: "big", Number: -1}}, wantErr: true},
+		{name: "invalid_memory", pools: []NodePool{{Name: "big", Number: 1, Memory: "8Go"}}, wantErr: true},
+		{
+			name:    "invalid_label",
+			pools:   []NodePool{{Name: "big", Labels: map[string]string{"node-role.kubernetes.io/big": ""}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &Cluster{Name: "app300", WorkerPools: tt.pools}
+			if err := cluster.validateWorkerPools(); (err != nil) != tt.wantErr {
+				t.Errorf("validateWorkerPools() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCluster_workerPools(t *testing.T) {
+	cluster := &Cluster{
+		Name:             "app300",
+		Image:            "22.04",
+		CmpNodesNumber:   1,
+		CmpNodesCores:    2,
+		CmpNodesMemory:   "4G",
+		CmpNodesDiskSize: "20G",
+		WorkerPools:      []NodePool{{Name: "big", Number: 2, Memory: "8G"}},
+	}
+	pools := cluster.workerPools()
+	if len(pools) != 2 || pools[0].Name != defaultWorkerPool || pools[1].Name != "big" {
+		t.Fatalf("workerPools() = %+v, want the cmp and big pools", pools)
+	}
+	big := pools[1]
+	if big.Cores != 2 || big.Memory != "8G" || big.DiskSize != "20G" || big.Image != "22.04" {
+		t.Errorf("workerPools() big pool = %+v, want the defaults of the cmp pool", big)
+	}
+	want := []string{"app300-cmp-0", "app300-big-0", "app300-big-1"}
+	if got := cluster.workerNodeNames(); !slices.Equal(got, want) {
+		t.Errorf("workerNodeNames() = %v, want %v", got, want)
+	}
+	if got := cluster.nodePool("app300-big-1"); got != "big" {
+		t.Errorf("nodePool() = %s, want big", got)
+	}
+	cluster.CmpNodesNumber = 0
+	if got := cluster.WorkerPoolNames(); !slices.Equal(got, []string{"big"}) {
+		t.Errorf("WorkerPoolNames() = %v, want [big]", got)
+	}
+}
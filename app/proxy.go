@@ -0,0 +1,152 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultServiceSubnet is the subnet of the kubernetes services, the kubeadm default.
+const defaultServiceSubnet = "10.96.0.0/12"
+
+// ProxyConfig is the HTTP proxy the VMs reach the internet through.
+type ProxyConfig struct {
+	// HTTPProxy and HTTPSProxy are the proxy URLs, eg: http://proxy.corp:3128.
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy are the extra hosts, domains and subnets reached without the proxy. The cluster subnets, node names and
+	// domains are added automatically.
+	NoProxy []string
+}
+
+// enabled returns true if a proxy is configured.
+func (config ProxyConfig) enabled() bool {
+	return config.HTTPProxy != "" || config.HTTPSProxy != ""
+}
+
+// validate checks the proxies are http(s) URLs.
+func (config ProxyConfig) validate() error {
+	for _, proxy := range []string{config.HTTPProxy, config.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		parsed, err := url.Parse(proxy)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return ErrProxy
+		}
+	}
+	return nil
+}
+
+// passwords returns the passwords of the proxy URLs, as written in the URLs and decoded, to redact them.
+func (config ProxyConfig) passwords() []string {
+	var passwords []string
+	for _, proxy := range []string{config.HTTPProxy, config.HTTPSProxy} {
+		parsed, err := url.Parse(proxy)
+		if err != nil || parsed.User == nil {
+			continue
+		}
+		if password, found := parsed.User.Password(); found && password != "" {
+			_, escaped, _ := strings.Cut(parsed.User.String(), ":")
+			passwords = append(passwords, escaped, password)
+		}
+	}
+	return passwords
+}
+
+// noProxy returns the hosts reached without the proxy: the extra ones of the proxy settings, the local addresses,
+// the pod and service subnets, the multipass network of the node IPs, and the cluster names and domains.
+func (cluster *Cluster) noProxy() []string {
+	noProxy := append([]string{}, cluster.Proxy.NoProxy...)
+	noProxy = append(noProxy, "localhost", "127.0.0.1", cluster.PodSubnet, defaultServiceSubnet)
+	if bridge, err := hostBridgeNetwork(); err == nil {
+		noProxy = append(noProxy, (&net.IPNet{IP: bridge.IP.Mask(bridge.Mask), Mask: bridge.Mask}).String())
+	} else {
+		Logger.Warn("multipass network not found, the node IPs are not added to NO_PROXY", "cluster", cluster.Name)
+	}
+	if cluster.VirtualIP != "" {
+		noProxy = append(noProxy, cluster.VirtualIP)
+	}
+	return append(noProxy, ".svc", ".cluster.local", "."+cluster.Name+".local", cluster.Name+"-registry",
+		cluster.PullCacheHost())
+}
+
+// proxyEnv returns the proxy variables, lower and upper case as tools read either of them.
+func (cluster *Cluster) proxyEnv() []string {
+	var env []string
+	add := func(name string, value string) {
+		if value != "" {
+			env = append(env, fmt.Sprintf("%s=%s", name, value), fmt.Sprintf("%s=%s", strings.ToUpper(name), value))
+		}
+	}
+	add("http_proxy", cluster.Proxy.HTTPProxy)
+	add("https_proxy", cluster.Proxy.HTTPSProxy)
+	add("no_proxy", strings.Join(cluster.noProxy(), ","))
+	return env
+}
+
+// proxyFiles returns the files configuring the proxy on the VMs: apt, the bootstrap script and the login sessions,
+// and systemd drop-ins for containerd image pulls and the kubelet.
+func (cluster *Cluster) proxyFiles() []BootstrapFile {
+	if !cluster.Proxy.enabled() {
+		return nil
+	}
+	env := cluster.proxyEnv()
+	var apt strings.Builder
+	if cluster.Proxy.HTTPProxy != "" {
+		fmt.Fprintf(&apt, "Acquire::http::Proxy \"%s\";\n", cluster.Proxy.HTTPProxy)
+	}
+	if cluster.Proxy.HTTPSProxy != "" {
+		fmt.Fprintf(&apt, "Acquire::https::Proxy \"%s\";\n", cluster.Proxy.HTTPSProxy)
+	}
+	var dropIn strings.Builder
+	dropIn.WriteString("[Service]\n")
+	for _, variable := range env {
+		fmt.Fprintf(&dropIn, "Environment=\"%s\"\n", variable)
+	}
+	file := func(path string, content string, appendContent bool) BootstrapFile {
+		return BootstrapFile{Path: path, Content: base64.StdEncoding.EncodeToString([]byte(content)), Append: appendContent}
+	}
+	envContent := strings.Join(env, "\n") + "\n"
+	return []BootstrapFile{
+		file("/etc/apt/apt.conf.d/95kmpass-proxy", apt.String(), false),
+		file("/etc/kmpass/proxy.env", envContent, false),
+		file("/etc/environment", envContent, true),
+		file("/etc/systemd/system/containerd.service.d/http-proxy.conf", dropIn.String(), false),
+		file("/etc/systemd/system/kubelet.service.d/http-proxy.conf", dropIn.String(), false),
+	}
+}
+
+// loadCACerts reads PEM bundles of the host, trusted by the VMs. Returns the certificates of the bundles, as expected
+// by the cloud init ca_certs module.
+func loadCACerts(paths []string) ([]string, error) {
+	var certs []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			Logger.Error("unable to read CA bundle", "err", err, "path", path)
+			return nil, ErrCACert
+		}
+		before := len(certs)
+		for {
+			var block *pem.Block
+			block, content = pem.Decode(content)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certs = append(certs, strings.TrimSpace(string(pem.EncodeToMemory(block))))
+		}
+		if len(certs) == before {
+			Logger.Error("CA bundle has no certificate", "path", path)
+			return nil, ErrCACert
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Registry options of the cluster local container registry.
+const (
+	// RegistryLB runs the registry on the first LB node.
+	RegistryLB = "lb"
+	// RegistryVM runs the registry on a dedicated registry VM.
+	RegistryVM = "vm"
+)
+
+const (
+	// registryPort is the port the registry listens on, on its VM.
+	registryPort = 5000
+	// registryImage is the container image of the registry.
+	registryImage = "registry:2"
+	// registryUser is the user of the registry basic authentication. The password is generated per cluster.
+	registryUser = "kmpass"
+	// registryCertDir is the directory of the registry TLS certificate and key on the registry VM.
+	registryCertDir = "/etc/kmpass-registry/certs"
+	// defaultRegistryDiskSize is the disk size of the registry VM, the images are stored on it.
+	defaultRegistryDiskSize = "20G"
+	// registryCAFileName is the CA of the registry certificate, the cluster CA, in the cluster directory.
+	registryCAFileName = "registry-ca.crt"
+	// registryPasswordFileName holds the password of the registry user in the cluster directory, for docker login.
+	registryPasswordFileName = "registry-password"
+)
+
+// registryHostsConfig is the data of the containerd registry templates.
+type registryHostsConfig struct {
+	Host     string
+	User     string
+	Password string
+}
+
+// RegistryName returns the name of the VM running the registry, empty if the cluster has no registry.
+func (cluster *Cluster) RegistryName() string {
+	switch cluster.Registry {
+	case RegistryLB:
+		return cluster.LBName()
+	case RegistryVM:
+		return fmt.Sprintf("%s-registry", cluster.Name)
+	default:
+		return ""
+	}
+}
+
+// registryVMName returns the name of the dedicated registry VM, empty if the registry does not use one.
+func (cluster *Cluster) registryVMName() string {
+	if cluster.Registry != RegistryVM {
+		return ""
+	}
+	return cluster.RegistryName()
+}
+
+// RegistryHost returns the address the nodes pull the registry images from, <cluster>-registry:5000. The name
+// resolves to the registry VM through /etc/hosts on the nodes.
+func (cluster *Cluster) RegistryHost() string {
+	return fmt.Sprintf("%s-registry:%d", cluster.Name, registryPort)
+}
+
+// SetupRegistry runs a registry on the registry VM, created first with the support VMs cloud init file if the
+// registry is a dedicated VM, with a TLS certificate signed by the cluster CA and a basic authentication. The nodes
+// are then configured to resolve and trust the registry, and containerd gets its credentials so that pods pull from
+// it without image pull secrets.
+func (cluster *Cluster) SetupRegistry() error {
+	registryName := cluster.RegistryName()
+	if registryName == "" {
+		return ErrRegistry
+	}
+	if cluster.Registry == RegistryVM {
+		cloudInitPath, err := GenerateConfigCloudInitSupport(cluster)
+		if err != nil {
+			return err
+		}
+		vm, err := NewInstanceConfig(1, "1G", defaultRegistryDiskSize, cluster.Image, registryName, cloudInitPath)
+		if err != nil {
+			Logger.Error("unable to create registry vm instance", "err", err, "instance-name", registryName)
+			return err
+		}
+		if !vm.Exist() {
+			if err := vm.Create(); err != nil {
+				Logger.Error("unable to create registry vm instance", "err", err, "instance-name", registryName)
+				return err
+			}
+		}
+	}
+	IP, err := (&Instance{Name: registryName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", registryName)
+		return err
+	}
+	if cluster.RegistryPassword == "" {
+		password := make([]byte, 12)
+		if _, err := rand.Read(password); err != nil {
+			Logger.Error("unable to generate registry password", "err", err)
+			return err
+		}
+		cluster.RegistryPassword = hex.EncodeToString(password)
+	}
+	dir, err := ClusterDir(cluster.Name)
+	if err != nil {
+		return err
+	}
+	passwordPath := filepath.Join(dir, registryPasswordFileName)
+	if err := os.WriteFile(passwordPath, []byte(cluster.RegistryPassword), 0600); err != nil {
+		Logger.Error("unable to write the registry password", "err", err, "path", passwordPath)
+		return ErrCreateFile
+	}
+	if err := cluster.issueRegistryCert(IP); err != nil {
+		return err
+	}
+	if err := cluster.runRegistry(registryName); err != nil {
+		return err
+	}
+	cluster.RegistryIP = IP
+	if err := cluster.SaveState(); err != nil {
+		return err
+	}
+	Logger.Info("registry ready", "instance-name", registryName, "registry", cluster.RegistryHost())
+
+	for _, nodeName := range cluster.NodeNames() {
+		if err := cluster.trustRegistry(nodeName); err != nil {
+			return err
+		}
+	}
+	Logger.Info("nodes trust the registry", "cluster", cluster.Name, "registry", cluster.RegistryHost())
+	return nil
+}
+
+// issueRegistryCert generates the registry key and a certificate for its name and IP, signed by the cluster CA on
+// the first control node. The key, the certificate and the CA are copied in the cluster directory.
+func (cluster *Cluster) issueRegistryCert(IP string) error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-%d", cluster.Name, 0)
+	host := strings.Split(cluster.RegistryHost(), ":")[0]
+	script := fmt.Sprintf("set -e; mkdir -p /tmp/kmpass-registry && cd /tmp/kmpass-registry && "+
+		"openssl req -newkey rsa:2048 -nodes -keyout registry.key -subj '/CN=%[1]s' -out registry.csr && "+
+		"echo 'subjectAltName=DNS:%[1]s,IP:%[2]s' > san.ext && "+
+		"openssl x509 -req -in registry.csr -CA /etc/kubernetes/pki/ca.crt -CAkey /etc/kubernetes/pki/ca.key "+
+		"-CAcreateserial -days 3650 -sha256 -extfile san.ext -out registry.crt && "+
+		"cp /etc/kubernetes/pki/ca.crt ca.crt && chown -R ubuntu:ubuntu /tmp/kmpass-registry", host, IP)
+	if out, err := RunCmd(firstCtrlName, []string{"sudo", "sh", "-c", script}); err != nil {
+		Logger.Error("unable to issue the registry certificate", "err", err, "output", out, "cluster", cluster.Name)
+		return err
+	}
+	dir, err := ClusterDir(cluster.Name)
+	if err != nil {
+		return err
+	}
+	files := map[string]string{"registry.key": "registry.key", "registry.crt": "registry.crt",
+		"ca.crt": registryCAFileName}
+	for src, dst := range files {
+		if err := TransferFrom(firstCtrlName, "/tmp/kmpass-registry/"+src, filepath.Join(dir, dst)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runRegistry installs docker on the registry VM and (re)starts the registry container with the certificate issued
+// by issueRegistryCert and a htpasswd file for the registry user.
+func (cluster *Cluster) runRegistry(registryName string) error {
+	dir, err := ClusterDir(cluster.Name)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"registry.key", "registry.crt"} {
+		if err := Transfer(registryName, filepath.Join(dir, name), name); err != nil {
+			return err
+		}
+	}
+	// the docker apt repository is only configured by the node bootstrap script, eg: on a LB node, the registry VM
+	// gets docker from the ubuntu archive
+	script := fmt.Sprintf("set -e; docker=docker.io; "+
+		"if apt-cache show docker-ce >/dev/null 2>&1; then docker=docker-ce; fi; "+
+		"apt-get install -y $docker apache2-utils && "+
+		"mkdir -p %[1]s /etc/kmpass-registry/auth /var/lib/kmpass-registry && "+
+		"mv /tmp/registry.key /tmp/registry.crt %[1]s/ && "+
+		"htpasswd -Bbc /etc/kmpass-registry/auth/htpasswd %[2]s %[3]s && "+
+		"(docker rm -f kmpass-registry || true) && "+
+		"docker run -d --name kmpass-registry --restart=always -p %[4]d:5000 "+
+		"-v %[1]s:/certs:ro -v /etc/kmpass-registry/auth:/auth:ro -v /var/lib/kmpass-registry:/var/lib/registry "+
+		"-e REGISTRY_HTTP_TLS_CERTIFICATE=/certs/registry.crt -e REGISTRY_HTTP_TLS_KEY=/certs/registry.key "+
+		"-e REGISTRY_AUTH=htpasswd -e REGISTRY_AUTH_HTPASSWD_REALM=kmpass "+
+		"-e REGISTRY_AUTH_HTPASSWD_PATH=/auth/htpasswd %[5]s",
+		registryCertDir, registryUser, cluster.RegistryPassword, registryPort, registryImage)
+	if out, err := RunCmd(registryName, []string{"sudo", "sh", "-c", script}); err != nil {
+		Logger.Error("unable to run the registry", "err", err, "output", out, "instance-name", registryName)
+		return err
+	}
+	return nil
+}
+
+// trustRegistry makes a node resolve the registry name, trust its certificate through the cluster CA and log in
+// with the registry credentials. containerd reads the certs.d directory, its configuration is only changed, and
+// containerd restarted, the first time. The containerd credentials are rendered in the cluster directory and removed
+// once transferred.
+func (cluster *Cluster) trustRegistry(nodeName string) error {
+	data := registryHostsConfig{Host: cluster.RegistryHost(), User: registryUser, Password: cluster.RegistryPassword}
+	hostsPath, err := renderTemplate("app/files/registry-hosts.toml.tpl", cluster.Name+"-registry-hosts.toml", data)
+	if err != nil {
+		return err
+	}
+	if err := Transfer(nodeName, hostsPath, "registry-hosts.toml"); err != nil {
+		return err
+	}
+	authPath, err := renderSecretTemplate("app/files/registry-auth.toml.tpl", cluster.Name, "registry-auth.toml", data)
+	if err != nil {
+		return err
+	}
+	err = Transfer(nodeName, authPath, "registry-auth.toml")
+	if rmErr := os.Remove(authPath); rmErr != nil {
+		Logger.Warn("unable to remove the registry credentials", "err", rmErr, "path", authPath)
+	}
+	if err != nil {
+		return err
+	}
+	host := cluster.RegistryHost()
+	name := strings.Split(host, ":")[0]
+	certsDir := "/etc/containerd/certs.d/" + host
+	script := fmt.Sprintf("set -e; sed -i '/ %[1]s$/d' /etc/hosts && echo '%[2]s %[1]s' >> /etc/hosts && "+
+		"mkdir -p %[3]s && cp /etc/kubernetes/pki/ca.crt %[3]s/ca.crt && mv /tmp/registry-hosts.toml %[3]s/hosts.toml && "+
+		"if ! grep -qF 'configs.\"%[4]s\".auth' /etc/containerd/config.toml; then "+
+		"sed -i 's|config_path = \"\"|config_path = \"/etc/containerd/certs.d\"|' /etc/containerd/config.toml && "+
+		"cat /tmp/registry-auth.toml >> /etc/containerd/config.toml && systemctl restart containerd; fi; "+
+		"rm -f /tmp/registry-auth.toml", name, cluster.registryIP(), certsDir, host)
+	if out, err := RunCmd(nodeName, []string{"sudo", "sh", "-c", script}); err != nil {
+		Logger.Error("unable to configure the registry on node", "err", err, "output", out, "instance-name", nodeName)
+		return err
+	}
+	return nil
+}
+
+// registryIP returns the address of the registry VM, read from the VM if the registry was never installed.
+func (cluster *Cluster) registryIP() string {
+	if cluster.RegistryIP != "" {
+		return cluster.RegistryIP
+	}
+	IP, _ := (&Instance{Name: cluster.RegistryName()}).GetIP()
+	return IP
+}
+
+// RegistryInstructions returns the commands to push images to the registry from the host.
+func (cluster *Cluster) RegistryInstructions() string {
+	host := cluster.RegistryHost()
+	name := strings.Split(host, ":")[0]
+	caPath := filepath.Join("~/kmpass", cluster.Name, registryCAFileName)
+	var b strings.Builder
+	fmt.Fprintf(&b, "The registry %s is ready. To push images from this host:\n", host)
+	fmt.Fprintf(&b, "  echo '%s %s' | sudo tee -a /etc/hosts\n", cluster.RegistryIP, name)
+	fmt.Fprintf(&b, "  sudo mkdir -p /etc/docker/certs.d/%[1]s && sudo cp %[2]s /etc/docker/certs.d/%[1]s/ca.crt\n",
+		host, caPath)
+	fmt.Fprintf(&b, "  docker login %s -u %s --password-stdin < %s\n", host, registryUser,
+		filepath.Join("~/kmpass", cluster.Name, registryPasswordFileName))
+	fmt.Fprintf(&b, "  docker tag myapp:dev %[1]s/myapp:dev && docker push %[1]s/myapp:dev\n", host)
+	fmt.Fprintf(&b, "Pods can then use the image %s/myapp:dev.", host)
+	return b.String()
+}
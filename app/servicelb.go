@@ -0,0 +1,243 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Providers of the LoadBalancer services.
+const (
+	// ServiceLBCilium uses the Cilium LB-IPAM and L2 announcements.
+	ServiceLBCilium = "cilium"
+	// ServiceLBMetalLB installs MetalLB in L2 mode.
+	ServiceLBMetalLB = "metallb"
+)
+
+// metalLBManifest is the MetalLB release installed when Cilium is not the CNI.
+const metalLBManifest = "https://raw.githubusercontent.com/metallb/metallb/v0.13.12/config/manifests/metallb-native.yaml"
+
+// serviceLBConfig is the data of the service LB address pool templates.
+type serviceLBConfig struct {
+	First     string
+	Last      string
+	Interface string
+}
+
+// ipv4ToUint converts an IPv4 address to an integer, to iterate over a subnet.
+func ipv4ToUint(IP net.IP) uint32 {
+	IP = IP.To4()
+	return uint32(IP[0])<<24 | uint32(IP[1])<<16 | uint32(IP[2])<<8 | uint32(IP[3])
+}
+
+// uintToIPv4 converts an integer back to an IPv4 address.
+func uintToIPv4(n uint32) string {
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String()
+}
+
+// parseIPRange parses a range of IPv4 addresses like 10.1.1.200-10.1.1.220.
+func parseIPRange(ipRange string) (string, string, error) {
+	first, last, found := strings.Cut(ipRange, "-")
+	firstIP, lastIP := net.ParseIP(strings.TrimSpace(first)), net.ParseIP(strings.TrimSpace(last))
+	if !found || firstIP.To4() == nil || lastIP.To4() == nil || ipv4ToUint(firstIP) > ipv4ToUint(lastIP) {
+		return "", "", ErrInvalidIPRange
+	}
+	return firstIP.String(), lastIP.String(), nil
+}
+
+// dnsmasqRange matches the DHCP range option of a dnsmasq command line, eg: --dhcp-range=10.1.1.2,10.1.1.254,infinite
+// with the multipass qemu driver or --dhcp-range 10.1.1.2,10.1.1.254,1h with LXD.
+var dnsmasqRange = regexp.MustCompile(`--dhcp-range[= ]([0-9.]+),([0-9.]+)`)
+
+// parseDHCPRange returns the DHCP pool of subnet read from the command lines of the host processes, as printed by
+// ps -eo args. found is false when no dnsmasq process serves subnet.
+func parseDHCPRange(processes string, subnet *net.IPNet) (first string, last string, found bool) {
+	for _, line := range strings.Split(processes, "\n") {
+		if !strings.Contains(line, "dnsmasq") {
+			continue
+		}
+		for _, match := range dnsmasqRange.FindAllStringSubmatch(line, -1) {
+			firstIP, lastIP := net.ParseIP(match[1]), net.ParseIP(match[2])
+			if firstIP.To4() != nil && lastIP.To4() != nil && subnet.Contains(firstIP) && subnet.Contains(lastIP) {
+				return firstIP.String(), lastIP.String(), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// hostDHCPRange returns the DHCP pool of the multipass subnet, read from the dnsmasq process multipass runs on Linux.
+// found is false on the other hosts, eg: macOS where multipass relies on the vmnet DHCP server.
+func hostDHCPRange(subnet *net.IPNet) (string, string, bool) {
+	out, err := exec.Command("ps", "-eo", "args").Output()
+	if err != nil {
+		Logger.Debug("unable to list the host processes", "err", err)
+		return "", "", false
+	}
+	return parseDHCPRange(string(out), subnet)
+}
+
+// serviceLBRange returns the highest range of size contiguous addresses of the subnet which does not contain any used
+// address nor any address of the DHCP pool dhcpFirst-dhcpLast, if set. The top of the subnet is where the multipass
+// DHCP server is the least likely to lease addresses, the range sits below the virtual IPs which are taken from the
+// very top.
+func serviceLBRange(subnet *net.IPNet, used []string, size int, dhcpFirst, dhcpLast string) (string, string, error) {
+	if subnet.IP.To4() == nil || size < 1 {
+		return "", "", ErrNoFreeServiceLBRange
+	}
+	ones, bits := subnet.Mask.Size()
+	start := ipv4ToUint(subnet.IP)
+	// skip the broadcast address, the network address and the gateway
+	top, bottom := start+uint32(1)<<uint32(bits-ones)-2, start+1
+	inDHCPPool := func(n uint32) bool { return false }
+	if dhcpFirst != "" && dhcpLast != "" {
+		poolFirst, poolLast := ipv4ToUint(net.ParseIP(dhcpFirst)), ipv4ToUint(net.ParseIP(dhcpLast))
+		inDHCPPool = func(n uint32) bool { return n >= poolFirst && n <= poolLast }
+	}
+	free := 0
+	for n := top; n > bottom; n-- {
+		if inDHCPPool(n) || containsIP(used, uintToIPv4(n)) {
+			free = 0
+			continue
+		}
+		free++
+		if free == size {
+			return uintToIPv4(n), uintToIPv4(n + uint32(size) - 1), nil
+		}
+	}
+	return "", "", ErrNoFreeServiceLBRange
+}
+
+// chooseServiceLBRange picks the address range of the LoadBalancer services in the multipass subnet of the first
+// control node. The addresses of the multipass VMs and the virtual IP are excluded, and the 10 addresses at the top
+// of the subnet are left for virtual IPs. The range must be outside the DHCP pool of the subnet, otherwise the DHCP
+// server can lease its addresses to a new VM: ErrNoFreeServiceLBRange is returned when the pool is not detected or
+// does not leave room for the range, eg: the default multipass pool spans the whole subnet.
+func (cluster *Cluster) chooseServiceLBRange(size int) (string, error) {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	IP, err := (&Instance{Name: firstCtrlName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", firstCtrlName)
+		return "", err
+	}
+	_, prefixLen, err := vmInterface(firstCtrlName, IP)
+	if err != nil {
+		return "", err
+	}
+	_, subnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", IP, prefixLen))
+	if err != nil {
+		return "", ErrInvalidIPV4Address
+	}
+	dhcpFirst, dhcpLast, found := hostDHCPRange(subnet)
+	if !found {
+		Logger.Error("multipass DHCP pool not detected, set the service LB range", "cluster", cluster.Name,
+			"subnet", subnet.String())
+		return "", ErrNoFreeServiceLBRange
+	}
+	instances, err := ListInstances()
+	if err != nil {
+		return "", err
+	}
+	used := append(virtualIPCandidates(subnet, nil, 10), cluster.VirtualIP)
+	for _, instance := range instances {
+		used = append(used, instance.IPv4...)
+	}
+	first, last, err := serviceLBRange(subnet, used, size, dhcpFirst, dhcpLast)
+	if err != nil {
+		Logger.Error("no room for the service LB range outside the multipass DHCP pool, set the range",
+			"cluster", cluster.Name, "dhcp-range", dhcpFirst+"-"+dhcpLast)
+		return "", err
+	}
+	return first + "-" + last, nil
+}
+
+// InstallServiceLB gives the services of type LoadBalancer routable IPs from the host, taken from an address range of
+// the multipass subnet announced with ARP by the nodes. The range is chosen automatically if ipRange is empty and
+// the cluster does not have one yet. Cilium LB-IPAM is used when the cluster was created with the Cilium kube-proxy
+// replacement, which its L2 announcements need, and provider is empty, MetalLB otherwise. The data path of the
+// services is not changed. The provider and range are kept in the cluster state.
+func (cluster *Cluster) InstallServiceLB(provider string, ipRange string, size int) error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	if provider == "" {
+		provider = ServiceLBMetalLB
+		if cluster.KubeProxyReplacement {
+			provider = ServiceLBCilium
+		}
+	}
+	if provider != ServiceLBCilium && provider != ServiceLBMetalLB {
+		return ErrServiceLBProvider
+	}
+	if provider == ServiceLBCilium && !cluster.KubeProxyReplacement {
+		return ErrKubeProxyReplacement
+	}
+	// the MetalLB manifest and images are not in the artifact cache
+	if provider == ServiceLBMetalLB && cluster.ArtifactsURL != "" {
+		return ErrOfflineFeature
+	}
+	if ipRange == "" {
+		ipRange = cluster.ServiceLBRange
+	}
+	if ipRange == "" {
+		chosen, err := cluster.chooseServiceLBRange(size)
+		if err != nil {
+			Logger.Error("unable to choose the service LB address range", "err", err, "cluster", cluster.Name)
+			return err
+		}
+		ipRange = chosen
+	}
+	first, last, err := parseIPRange(ipRange)
+	if err != nil {
+		return err
+	}
+	IP, err := (&Instance{Name: firstCtrlName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", firstCtrlName)
+		return err
+	}
+	iface, _, err := vmInterface(firstCtrlName, IP)
+	if err != nil {
+		return err
+	}
+
+	var steps []string
+	if provider == ServiceLBCilium {
+		// the kube-proxy replacement was set by InstallCNI, the values are reused
+		steps = []string{
+			"cilium upgrade --reuse-values --set l2announcements.enabled=true --set externalIPs.enabled=true",
+			"kubectl -n kube-system rollout restart deployment/cilium-operator daemonset/cilium",
+			"cilium status --wait",
+		}
+	} else {
+		// the pods do not exist right after the apply, kubectl wait would fail
+		steps = []string{
+			"kubectl apply -f " + metalLBManifest,
+			"kubectl -n metallb-system rollout status deployment/controller daemonset/speaker --timeout=180s",
+		}
+	}
+	for _, step := range steps {
+		if out, err := RunCmd(firstCtrlName, []string{"sh", "-c", step}); err != nil {
+			Logger.Error("unable to install the service LB", "err", err, "output", out, "step", step,
+				"cluster", cluster.Name)
+			return err
+		}
+	}
+	config := serviceLBConfig{First: first, Last: last, Interface: iface}
+	poolPath, err := renderTemplate(fmt.Sprintf("app/files/service-lb-%s.yaml.tpl", provider), "service-lb.yaml", config)
+	if err != nil {
+		return err
+	}
+	if err := Transfer(firstCtrlName, poolPath, "service-lb.yaml"); err != nil {
+		return err
+	}
+	if out, err := RunCmd(firstCtrlName, []string{"kubectl", "apply", "-f", "/tmp/service-lb.yaml"}); err != nil {
+		Logger.Error("unable to create the service LB address pool", "err", err, "output", out,
+			"cluster", cluster.Name)
+		return err
+	}
+	cluster.ServiceLBProvider = provider
+	cluster.ServiceLBRange = first + "-" + last
+	Logger.Info("service LB installed", "cluster", cluster.Name, "provider", provider, "range", cluster.ServiceLBRange)
+	return cluster.SaveState()
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		ipRange   string
+		wantFirst string
+		wantLast  string
+		wantErr   bool
+	}{
+		{name: "range_good", ipRange: "10.1.1.200-10.1.1.220", wantFirst: "10.1.1.200", wantLast: "10.1.1.220"},
+		{name: "range_single_address", ipRange: "10.1.1.200-10.1.1.200", wantFirst: "10.1.1.200", wantLast: "10.1.1.200"},
+		{name: "range_reversed", ipRange: "10.1.1.220-10.1.1.200", wantErr: true},
+		{name: "range_cidr", ipRange: "10.1.1.0/24", wantErr: true},
+		{name: "range_ipv6", ipRange: "fd00::1-fd00::10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, err := parseIPRange(tt.ipRange)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseIPRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if first != tt.wantFirst || last != tt.wantLast {
+				t.Errorf("parseIPRange() = %s-%s, want %s-%s", first, last, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestServiceLBRange(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	tests := []struct {
+		name      string
+		used      []string
+		size      int
+		dhcpRange []string
+		wantFirst string
+		wantLast  string
+		wantErr   bool
+	}{
+		{name: "range_top", used: nil, size: 4, wantFirst: "10.1.1.251", wantLast: "10.1.1.254"},
+		{name: "range_skip_used", used: []string{"10.1.1.252"}, size: 4, wantFirst: "10.1.1.248", wantLast: "10.1.1.251"},
+		{name: "range_too_big", used: nil, size: 300, wantErr: true},
+		{
+			name:      "range_below_dhcp_pool",
+			size:      4,
+			dhcpRange: []string{"10.1.1.100", "10.1.1.254"},
+			wantFirst: "10.1.1.96",
+			wantLast:  "10.1.1.99",
+		},
+		{name: "range_no_room_outside_dhcp_pool", size: 4, dhcpRange: []string{"10.1.1.2", "10.1.1.254"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dhcpFirst, dhcpLast := "", ""
+			if tt.dhcpRange != nil {
+				dhcpFirst, dhcpLast = tt.dhcpRange[0], tt.dhcpRange[1]
+			}
+			first, last, err := serviceLBRange(subnet, tt.used, tt.size, dhcpFirst, dhcpLast)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("serviceLBRange() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if first != tt.wantFirst || last != tt.wantLast {
+				t.Errorf("serviceLBRange() = %s-%s, want %s-%s", first, last, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestParseDHCPRange(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.1.0/24")
+	tests := []struct {
+		name      string
+		processes string
+		wantFirst string
+		wantLast  string
+		wantFound bool
+	}{
+		{
+			name: "multipass_qemu",
+			processes: "/usr/sbin/dnsmasq --keep-in-foreground --strict-order --bind-interfaces " +
+				"--listen-address=10.1.1.1 --dhcp-range=10.1.1.2,10.1.1.254,infinite --dhcp-leasefile=x\n",
+			wantFirst: "10.1.1.2",
+			wantLast:  "10.1.1.254",
+			wantFound: true,
+		},
+		{
+			name:      "lxd",
+			processes: "dnsmasq --keep-in-foreground --dhcp-range 10.1.1.50,10.1.1.150,1h -s lxd\n",
+			wantFirst: "10.1.1.50",
+			wantLast:  "10.1.1.150",
+			wantFound: true,
+		},
+		{name: "other_subnet", processes: "dnsmasq --dhcp-range=192.168.122.2,192.168.122.254\n"},
+		{name: "no_dnsmasq", processes: "/usr/bin/multipassd --verbose debug\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, found := parseDHCPRange(tt.processes, subnet)
+			if first != tt.wantFirst || last != tt.wantLast || found != tt.wantFound {
+				t.Errorf("parseDHCPRange() = %s-%s %v, want %s-%s %v", first, last, found, tt.wantFirst, tt.wantLast,
+					tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestCluster_kubeProxyReplacementRequired(t *testing.T) {
+	cluster := &Cluster{Name: "app300"}
+	err := cluster.InstallServiceLB(ServiceLBCilium, "10.1.1.200-10.1.1.220", 16)
+	if !errors.Is(err, ErrKubeProxyReplacement) {
+		t.Errorf("InstallServiceLB() error = %v, want %v", err, ErrKubeProxyReplacement)
+	}
+	if err := cluster.InstallIngress(IngressCilium); !errors.Is(err, ErrKubeProxyReplacement) {
+		t.Errorf("InstallIngress() error = %v, want %v", err, ErrKubeProxyReplacement)
+	}
+}
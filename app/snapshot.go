@@ -0,0 +1,129 @@
+package app
+
+import (
+	"regexp"
+	"time"
+)
+
+// SnapshotInfo describes a cluster snapshot. Each VM of the cluster has a multipass snapshot with the same name.
+type SnapshotInfo struct {
+	Name              string
+	CreatedAt         time.Time
+	Nodes             []string
+	KubernetesVersion string
+}
+
+// snapshotNameRegex is the format accepted by multipass for snapshot names.
+var snapshotNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*$`)
+
+// vmNames returns the names of all the VMs of the cluster in start order: storage, registry, load balancer, control
+// nodes and workers.
+func (cluster *Cluster) vmNames() []string {
+	var names []string
+	if storageName := cluster.storageVMName(); storageName != "" {
+		names = append(names, storageName)
+	}
+	if registryName := cluster.registryVMName(); registryName != "" {
+		names = append(names, registryName)
+	}
+	return append(append(names, cluster.LBNames()...), cluster.NodeNames()...)
+}
+
+// Stop stops the VMs of the cluster, workers first and load balancer last, so that the control plane does not
+// reschedule workloads while the cluster is going down.
+func (cluster *Cluster) Stop() error {
+	names := cluster.vmNames()
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := (&Instance{Name: names[i]}).Stop(); err != nil {
+			Logger.Error("unable to stop vm", "err", err, "instance-name", names[i], "cluster", cluster.Name)
+			return err
+		}
+		Logger.Info("vm stopped", "instance-name", names[i])
+	}
+	return nil
+}
+
+// Start starts the VMs of the cluster, load balancer and control nodes first. The VMs may get new IP addresses when
+// they start, so the LB configuration is synced afterwards.
+func (cluster *Cluster) Start() error {
+	for _, name := range cluster.vmNames() {
+		if err := (&Instance{Name: name}).Start(); err != nil {
+			Logger.Error("unable to start vm", "err", err, "instance-name", name, "cluster", cluster.Name)
+			return err
+		}
+		Logger.Info("vm started", "instance-name", name)
+	}
+	if _, err := cluster.SyncLB(); err != nil {
+		Logger.Error("unable to sync LB configuration", "err", err, "cluster", cluster.Name)
+		return err
+	}
+	return nil
+}
+
+// findSnapshot returns the snapshot of the cluster with the given name, or nil.
+func (cluster *Cluster) findSnapshot(name string) *SnapshotInfo {
+	for i := range cluster.Snapshots {
+		if cluster.Snapshots[i].Name == name {
+			return &cluster.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// Snapshot stops the cluster, takes a multipass snapshot of every VM with the given name and starts the cluster
+// again. The snapshot is recorded in the cluster state.
+func (cluster *Cluster) Snapshot(name string) error {
+	if !snapshotNameRegex.MatchString(name) {
+		return ErrSnapshotName
+	}
+	if cluster.findSnapshot(name) != nil {
+		return ErrSnapshotExist
+	}
+	snapshot := SnapshotInfo{
+		Name:              name,
+		Nodes:             cluster.vmNames(),
+		KubernetesVersion: cluster.KubernetesVersion,
+	}
+	if version, err := cluster.ServerVersion(); err == nil {
+		snapshot.KubernetesVersion = version.String()
+	}
+	if err := cluster.Stop(); err != nil {
+		return err
+	}
+	for _, vmName := range snapshot.Nodes {
+		if err := (&Instance{Name: vmName}).Snapshot(name); err != nil {
+			Logger.Error("unable to snapshot vm", "err", err, "instance-name", vmName, "snapshot", name)
+			return err
+		}
+	}
+	snapshot.CreatedAt = time.Now()
+	cluster.Snapshots = append(cluster.Snapshots, snapshot)
+	if err := cluster.SaveState(); err != nil {
+		return err
+	}
+	Logger.Info("cluster snapshot taken", "cluster", cluster.Name, "snapshot", name)
+	return cluster.Start()
+}
+
+// Restore stops the cluster, restores every VM to the snapshot with the given name and starts the cluster again.
+func (cluster *Cluster) Restore(name string) error {
+	snapshot := cluster.findSnapshot(name)
+	if snapshot == nil {
+		return ErrSnapshotNotFound
+	}
+	if err := cluster.Stop(); err != nil {
+		return err
+	}
+	for _, vmName := range snapshot.Nodes {
+		if err := (&Instance{Name: vmName}).Restore(name); err != nil {
+			Logger.Error("unable to restore vm", "err", err, "instance-name", vmName, "snapshot", name)
+			return err
+		}
+	}
+	cluster.KubernetesVersion = snapshot.KubernetesVersion
+	if err := cluster.SaveState(); err != nil {
+		return err
+	}
+	Logger.Info("cluster snapshot restored", "cluster", cluster.Name, "snapshot", name)
+	return cluster.Start()
+}
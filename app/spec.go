@@ -0,0 +1,25 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+)
+
+// LoadSpec reads a cluster spec file and applies it on top of the cluster configuration. The spec is a JSON document
+// with the same fields as Cluster, eg: {"CmpNodesNumber": 3, "LB": {"Listeners": [...]}}. Fields absent from the spec
+// keep their current value, which allows the spec to override the command line flags.
+func (cluster *Cluster) LoadSpec(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		Logger.Error("unable to read cluster spec", "err", err, "path", path)
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cluster); err != nil {
+		Logger.Error("unable to decode cluster spec", "err", err, "path", path)
+		return ErrInvalidSpec
+	}
+	return nil
+}
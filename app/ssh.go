@@ -0,0 +1,100 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigFileName is the name of the ssh_config snippet, in the cluster directory.
+const sshConfigFileName = "ssh_config"
+
+// sshKeyTypes are the prefixes of the public key types accepted by OpenSSH.
+var sshKeyTypes = []string{"ssh-", "ecdsa-", "sk-"}
+
+// sshHost is a Host entry of the ssh_config snippet.
+type sshHost struct {
+	Name      string
+	IP        string
+	ProxyJump string
+}
+
+// sshConfig is the data of the ssh_config template.
+type sshConfig struct {
+	Cluster string
+	Hosts   []sshHost
+}
+
+// validateSSHKeys checks the keys are OpenSSH public keys, eg: ssh-ed25519 AAAAC3... user@host.
+func validateSSHKeys(keys []string) error {
+	for _, key := range keys {
+		fields := strings.Fields(key)
+		if len(fields) < 2 || strings.ContainsAny(key, "\r\n") {
+			return ErrSSHKey
+		}
+		valid := false
+		for _, prefix := range sshKeyTypes {
+			valid = valid || strings.HasPrefix(fields[0], prefix)
+		}
+		if !valid {
+			return ErrSSHKey
+		}
+	}
+	return nil
+}
+
+// defaultSSHKeys returns the public keys of the user, ~/.ssh/id_*.pub.
+func defaultSSHKeys() []string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join(homeDir, ".ssh", "id_*.pub"))
+	var keys []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			Logger.Warn("unable to read ssh public key", "err", err, "path", path)
+			continue
+		}
+		if key := strings.TrimSpace(string(content)); validateSSHKeys([]string{key}) == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sshAuthorizedKeys returns the public keys authorized on the ubuntu user of the VMs: the keys of the cluster, or
+// the keys of the user if there are none.
+func (cluster *Cluster) sshAuthorizedKeys() []string {
+	if len(cluster.SSHAuthorizedKeys) > 0 {
+		return cluster.SSHAuthorizedKeys
+	}
+	return defaultSSHKeys()
+}
+
+// WriteSSHConfig writes, in the cluster directory, an ssh_config snippet with a Host entry per VM of the cluster and
+// its current IP. With jump, the other VMs are reached through the first LB node, for ssh clients which only reach
+// the LB. Returns the path of the snippet, to include in ~/.ssh/config.
+func (cluster *Cluster) WriteSSHConfig(jump bool) (string, error) {
+	if jump && cluster.LBMode == LBModeKubeVIP {
+		return "", ErrNoLBNode
+	}
+	config := sshConfig{Cluster: cluster.Name}
+	for _, name := range cluster.vmNames() {
+		IP, err := (&Instance{Name: name}).GetIP()
+		if err != nil {
+			Logger.Warn("vm IP address not found, it is not in the ssh config", "err", err, "instance-name", name)
+			continue
+		}
+		host := sshHost{Name: name, IP: IP}
+		if jump && name != cluster.LBName() {
+			host.ProxyJump = cluster.LBName()
+		}
+		config.Hosts = append(config.Hosts, host)
+	}
+	if _, err := ClusterDir(cluster.Name); err != nil {
+		return "", err
+	}
+	return renderTemplate("app/files/ssh_config.tpl", filepath.Join(cluster.Name, sshConfigFileName), config)
+}
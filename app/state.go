@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// stateFileName is the name of the file, in the cluster directory, in which the cluster state is persisted.
+const stateFileName = "state.json"
+
+// KmpassDir returns the kmpass working directory on the host (~/kmpass). Generated artifacts are stored there.
+func KmpassDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		Logger.Error("cannot get home dir", "err", err)
+		return "", ErrGetHomeDirectory
+	}
+	return filepath.Join(homeDir, "kmpass"), nil
+}
+
+// ClusterDir returns the per-cluster directory on the host (~/kmpass/<cluster>) and creates it if needed. It holds
+// the cluster state and the files kmpass produces for this cluster only.
+func ClusterDir(clusterName string) (string, error) {
+	kmpassDir, err := KmpassDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(kmpassDir, clusterName)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		Logger.Error("unable to create cluster directory", "err", err, "path", dir)
+		return "", ErrCreateFile
+	}
+	return dir, nil
+}
+
+// SaveState persists the cluster configuration and its discovered attributes (IPs, endpoint) on the host so that
+// later kmpass commands can operate on the cluster without the creation flags. The file contains the bootstrap
+// secrets, so it is only readable by the user.
+func (cluster *Cluster) SaveState() error {
+	dir, err := ClusterDir(cluster.Name)
+	if err != nil {
+		return err
+	}
+	cluster.Mux.Lock()
+	content, err := json.MarshalIndent(cluster, "", "  ")
+	cluster.Mux.Unlock()
+	if err != nil {
+		Logger.Error("unable to encode cluster state", "err", err, "cluster", cluster.Name)
+		return err
+	}
+	statePath := filepath.Join(dir, stateFileName)
+	if err := os.WriteFile(statePath, content, 0600); err != nil {
+		Logger.Error("unable to write cluster state", "err", err, "path", statePath)
+		return ErrCreateFile
+	}
+	return nil
+}
+
+// LoadState reads the state of a cluster previously saved with SaveState. ErrClusterStateNotFound is returned if the
+// cluster was never created by kmpass on this host.
+func LoadState(clusterName string) (*Cluster, error) {
+	kmpassDir, err := KmpassDir()
+	if err != nil {
+		return nil, err
+	}
+	statePath := filepath.Join(kmpassDir, clusterName, stateFileName)
+	content, err := os.ReadFile(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrClusterStateNotFound
+		}
+		Logger.Error("unable to read cluster state", "err", err, "path", statePath)
+		return nil, err
+	}
+	cluster := new(Cluster)
+	if err := json.Unmarshal(content, cluster); err != nil {
+		Logger.Error("unable to decode cluster state", "err", err, "path", statePath)
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// InheritState copies from the saved state of the cluster, if any, the attributes which are only known from previous
+// kmpass runs: virtual IP, LB stats password, kubernetes version and snapshots. This is used when the cluster creation
+// is run again on an existing cluster, so that saving the state does not lose them.
+func (cluster *Cluster) InheritState() {
+	previous, err := LoadState(cluster.Name)
+	if err != nil {
+		return
+	}
+	if cluster.VirtualIP == "" {
+		cluster.VirtualIP = previous.VirtualIP
+	}
+	if cluster.LB.StatsPassword == "" {
+		cluster.LB.StatsPassword = previous.LB.StatsPassword
+	}
+	if cluster.ServiceLBRange == "" {
+		cluster.ServiceLBRange = previous.ServiceLBRange
+	}
+	// the kube-proxy replacement of the cluster is kept when the creation runs again
+	cluster.KubeProxyReplacement = cluster.KubeProxyReplacement || previous.KubeProxyReplacement
+	cluster.ServiceLBProvider = previous.ServiceLBProvider
+	if cluster.Ingress == "" {
+		cluster.Ingress = previous.Ingress
+	}
+	cluster.InstalledAddons = previous.InstalledAddons
+	cluster.StorageIP = previous.StorageIP
+	cluster.RegistryIP = previous.RegistryIP
+	cluster.RegistryPassword = previous.RegistryPassword
+	cluster.KubernetesVersion = previous.KubernetesVersion
+	cluster.Snapshots = previous.Snapshots
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"fmt"
+	"net"
+)
+
+// Storage options of the cluster default StorageClass.
+const (
+	// StorageLB exports an NFS directory from the first LB node.
+	StorageLB = "lb"
+	// StorageVM exports an NFS directory from a dedicated storage VM.
+	StorageVM = "vm"
+)
+
+const (
+	// nfsExportDir is the directory exported by the NFS server, the volumes are sub directories of it.
+	nfsExportDir = "/srv/nfs/kmpass"
+	// nfsProvisionerVersion is the nfs-subdir-external-provisioner helm chart deployed in the cluster.
+	nfsProvisionerVersion = "4.0.18"
+	// storageClassName is the name of the default StorageClass backed by the NFS export.
+	storageClassName = "nfs"
+	// defaultStorageDiskSize is the disk size of the storage VM when none is set.
+	defaultStorageDiskSize = "20G"
+)
+
+// StorageName returns the name of the VM exporting the NFS directory, empty if the cluster has no storage.
+func (cluster *Cluster) StorageName() string {
+	switch cluster.Storage {
+	case StorageLB:
+		return cluster.LBName()
+	case StorageVM:
+		return fmt.Sprintf("%s-nfs", cluster.Name)
+	default:
+		return ""
+	}
+}
+
+// storageVMName returns the name of the dedicated storage VM, empty if the storage does not use one.
+func (cluster *Cluster) storageVMName() string {
+	if cluster.Storage != StorageVM {
+		return ""
+	}
+	return cluster.StorageName()
+}
+
+// SetupStorage installs an NFS server on the storage VM, created first with the support VMs cloud init file if the
+// storage is a dedicated VM, exports a directory to the multipass subnet and deploys the NFS subdir provisioner in the
+// cluster as the default StorageClass. The nodes get nfs-common from the cloud init file when the cluster has storage.
+func (cluster *Cluster) SetupStorage() error {
+	storageName := cluster.StorageName()
+	if storageName == "" {
+		return ErrStorage
+	}
+	if cluster.Storage == StorageVM {
+		if cluster.StorageDiskSize == "" {
+			cluster.StorageDiskSize = defaultStorageDiskSize
+		}
+		cloudInitPath, err := GenerateConfigCloudInitSupport(cluster)
+		if err != nil {
+			return err
+		}
+		vm, err := NewInstanceConfig(1, "1G", cluster.StorageDiskSize, cluster.Image, storageName, cloudInitPath)
+		if err != nil {
+			Logger.Error("unable to create storage vm instance", "err", err, "instance-name", storageName)
+			return err
+		}
+		if !vm.Exist() {
+			if err := vm.Create(); err != nil {
+				Logger.Error("unable to create storage vm instance", "err", err, "instance-name", storageName)
+				return err
+			}
+		}
+	}
+	IP, err := (&Instance{Name: storageName}).GetIP()
+	if err != nil {
+		Logger.Error("unable to retrieve vm IP address", "err", err, "instance-name", storageName)
+		return err
+	}
+	_, prefixLen, err := vmInterface(storageName, IP)
+	if err != nil {
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", IP, prefixLen))
+	if err != nil {
+		return ErrInvalidIPV4Address
+	}
+	script := fmt.Sprintf("apt-get install -y nfs-kernel-server && mkdir -p %[1]s /etc/exports.d && "+
+		"chown nobody:nogroup %[1]s && chmod 0777 %[1]s && "+
+		"echo '%[1]s %[2]s(rw,sync,no_subtree_check,no_root_squash)' > /etc/exports.d/kmpass.exports && "+
+		"systemctl enable nfs-server && systemctl restart nfs-server && exportfs -ra", nfsExportDir, subnet.String())
+	if out, err := RunCmd(storageName, []string{"sudo", "sh", "-c", script}); err != nil {
+		Logger.Error("unable to install the NFS server", "err", err, "output", out, "instance-name", storageName)
+		return err
+	}
+	cluster.StorageIP = IP
+	if err := cluster.SaveState(); err != nil {
+		return err
+	}
+	Logger.Info("NFS export ready", "instance-name", storageName, "export", IP+":"+nfsExportDir)
+
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	provisioner := fmt.Sprintf("helm upgrade --install nfs-provisioner nfs-subdir-external-provisioner "+
+		"--repo https://kubernetes-sigs.github.io/nfs-subdir-external-provisioner/ --version %s "+
+		"--namespace nfs-provisioner --create-namespace --set nfs.server=%s --set nfs.path=%s "+
+		"--set storageClass.name=%s --set storageClass.defaultClass=true --wait --timeout 5m",
+		nfsProvisionerVersion, IP, nfsExportDir, storageClassName)
+	if out, err := RunCmd(firstCtrlName, []string{"sh", "-c", provisioner}); err != nil {
+		Logger.Error("unable to install the NFS provisioner", "err", err, "output", out, "cluster", cluster.Name)
+		return err
+	}
+	Logger.Info("default StorageClass installed", "cluster", cluster.Name, "storage-class", storageClassName)
+	return nil
+}
@@ -0,0 +1,252 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lbBackendsTimeout is how long the upgrade waits for the kube API backends of the LB to be all up again.
+const lbBackendsTimeout = 5 * time.Minute
+
+// KubeVersion is a kubernetes release version, eg: 1.25.5
+type KubeVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseKubeVersion parses a kubernetes version, with or without the v prefix.
+func ParseKubeVersion(version string) (KubeVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+	if len(parts) != 3 {
+		return KubeVersion{}, ErrInvalidKubeVersion
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return KubeVersion{}, ErrInvalidKubeVersion
+		}
+		numbers[i] = n
+	}
+	return KubeVersion{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// String returns the version in the format used by kubeadm, eg: v1.25.5
+func (v KubeVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// aptVersion returns the version of the kubernetes packages of the apt repository configured by install.sh.
+func (v KubeVersion) aptVersion() string {
+	return fmt.Sprintf("%d.%d.%d-00", v.Major, v.Minor, v.Patch)
+}
+
+// pkgsRepository returns the kubernetes community apt repository of the minor version, eg:
+// https://pkgs.k8s.io/core:/stable:/v1.26/deb/. Unlike the legacy repository of install.sh, frozen at 1.25, it serves
+// the newer minor versions.
+func (v KubeVersion) pkgsRepository() string {
+	return fmt.Sprintf("https://pkgs.k8s.io/core:/stable:/v%d.%d/deb/", v.Major, v.Minor)
+}
+
+// pkgsVersion returns the version of the kubernetes packages of the community repository, eg: 1.26.3-1.1
+func (v KubeVersion) pkgsVersion() string {
+	return fmt.Sprintf("%d.%d.%d-1.1", v.Major, v.Minor, v.Patch)
+}
+
+// checkUpgradePath verifies that a cluster can be upgraded from one version to another. Kubernetes does not support
+// skipping minor versions, nor downgrades.
+func checkUpgradePath(from KubeVersion, to KubeVersion) error {
+	if to.Major != from.Major || to.Minor < from.Minor || to.Minor > from.Minor+1 {
+		return ErrKubeVersionSkew
+	}
+	if to.Minor == from.Minor && to.Patch <= from.Patch {
+		return ErrKubeVersionSkew
+	}
+	return nil
+}
+
+// ServerVersion returns the version of the kubernetes API server, read from the first control node.
+func (cluster *Cluster) ServerVersion() (KubeVersion, error) {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	out, err := RunCmd(firstCtrlName, []string{"kubectl", "version", "-o", "json"})
+	if err != nil {
+		Logger.Error("unable to get kubernetes version", "err", err, "output", out, "cluster", cluster.Name)
+		return KubeVersion{}, err
+	}
+	var versions struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal([]byte(out), &versions); err != nil {
+		Logger.Error("unable to decode kubernetes version", "err", err, "output", out, "cluster", cluster.Name)
+		return KubeVersion{}, ErrUnexpectedOutput
+	}
+	return ParseKubeVersion(versions.ServerVersion.GitVersion)
+}
+
+// installKubePackages installs the given kubernetes packages at the target version on a node, keeping them held. The
+// node is switched to the community repository of the target minor version first, replacing the legacy one.
+func installKubePackages(vmName string, version KubeVersion, packages ...string) error {
+	pinned := make([]string, len(packages))
+	for i, pkg := range packages {
+		pinned[i] = pkg + "=" + version.pkgsVersion()
+	}
+	repository := fmt.Sprintf("mkdir -p /etc/apt/keyrings && curl -fsSL %[1]sRelease.key | "+
+		"gpg --dearmor --yes -o /etc/apt/keyrings/kubernetes-apt-keyring.gpg && "+
+		"echo 'deb [signed-by=/etc/apt/keyrings/kubernetes-apt-keyring.gpg] %[1]s /' > "+
+		"/etc/apt/sources.list.d/kubernetes.list", version.pkgsRepository())
+	script := fmt.Sprintf("%[3]s && apt-mark unhold %[1]s && apt-get update && "+
+		"DEBIAN_FRONTEND=noninteractive apt-get install -y --allow-change-held-packages %[2]s && apt-mark hold %[1]s",
+		strings.Join(packages, " "), strings.Join(pinned, " "), repository)
+	out, err := RunCmd(vmName, []string{"sudo", "sh", "-c", script})
+	if err != nil {
+		Logger.Error("unable to upgrade kubernetes packages", "err", err, "output", out, "instance-name", vmName)
+	}
+	return err
+}
+
+// Upgrade performs a rolling upgrade of the cluster to the target kubernetes version, following the kubeadm upgrade
+// procedure: kubeadm is upgraded on the first control node which runs kubeadm upgrade apply, then every node, first
+// control node included, is drained, upgraded with kubeadm upgrade node and uncordoned, one at a time. The kube API
+// backends of the LB must be all up before moving to the next node. The upgrade refuses to skip minor versions.
+func (cluster *Cluster) Upgrade(target string) error {
+	to, err := ParseKubeVersion(target)
+	if err != nil {
+		return err
+	}
+	from, err := cluster.ServerVersion()
+	if err != nil {
+		return err
+	}
+	if err := checkUpgradePath(from, to); err != nil {
+		Logger.Error("invalid upgrade path", "err", err, "from", from.String(), "to", to.String())
+		return err
+	}
+	if err := cluster.waitAPIHealthy(lbBackendsTimeout); err != nil {
+		Logger.Error("cluster is not healthy, upgrade not started", "err", err, "cluster", cluster.Name)
+		return err
+	}
+	Logger.Info("upgrading cluster", "cluster", cluster.Name, "from", from.String(), "to", to.String())
+
+	// 1. upgrade the control plane from the first control node
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	if err := installKubePackages(firstCtrlName, to, "kubeadm"); err != nil {
+		return err
+	}
+	out, err := RunCmd(firstCtrlName, []string{"sudo", "kubeadm", "upgrade", "plan", to.String()})
+	if err != nil {
+		Logger.Error("kubeadm upgrade plan failed", "err", err, "output", out, "cluster", cluster.Name)
+		return err
+	}
+	Logger.Debug("kubeadm upgrade plan", "output", out)
+	out, err = RunCmd(firstCtrlName, []string{"sudo", "kubeadm", "upgrade", "apply", to.String(), "-y"})
+	if err != nil {
+		Logger.Error("kubeadm upgrade apply failed", "err", err, "output", out, "cluster", cluster.Name)
+		return err
+	}
+	Logger.Info("control plane upgraded", "cluster", cluster.Name, "version", to.String())
+
+	// 2. upgrade the nodes one at a time
+	for _, vmName := range cluster.NodeNames() {
+		if err := cluster.upgradeNode(vmName, to, vmName == firstCtrlName); err != nil {
+			return err
+		}
+		if err := cluster.waitAPIHealthy(lbBackendsTimeout); err != nil {
+			Logger.Error("load balancer backends not healthy after node upgrade", "err", err, "instance-name", vmName)
+			return err
+		}
+		Logger.Info("node upgraded", "instance-name", vmName, "version", to.String())
+	}
+	cluster.KubernetesVersion = to.String()
+	return cluster.SaveState()
+}
+
+// upgradeNode drains a node, upgrades its kubernetes packages and configuration and uncordons it. kubectl commands
+// are run from the first control node. The first control node configuration was already upgraded by kubeadm upgrade
+// apply, so only its packages are upgraded. The node is uncordoned even if its upgrade fails.
+func (cluster *Cluster) upgradeNode(vmName string, to KubeVersion, upgradeApplied bool) error {
+	firstCtrlName := fmt.Sprintf("%s-ctrl-0", cluster.Name)
+	drainCmd := []string{"kubectl", "drain", vmName, "--ignore-daemonsets", "--delete-emptydir-data", "--timeout=5m"}
+	if out, err := RunCmd(firstCtrlName, drainCmd); err != nil {
+		Logger.Error("unable to drain node", "err", err, "output", out, "instance-name", vmName)
+		return err
+	}
+	uncordonCmd := []string{"kubectl", "uncordon", vmName}
+	if err := upgradeDrainedNode(vmName, to, upgradeApplied); err != nil {
+		if out, uncordonErr := RunCmd(firstCtrlName, uncordonCmd); uncordonErr != nil {
+			Logger.Error("node is left cordoned", "err", uncordonErr, "output", out, "instance-name", vmName)
+		}
+		return err
+	}
+	if out, err := RunCmd(firstCtrlName, uncordonCmd); err != nil {
+		Logger.Error("unable to uncordon node", "err", err, "output", out, "instance-name", vmName)
+		return err
+	}
+	return nil
+}
+
+// upgradeDrainedNode upgrades the kubernetes packages and configuration of a drained node and restarts its kubelet.
+func upgradeDrainedNode(vmName string, to KubeVersion, upgradeApplied bool) error {
+	if !upgradeApplied {
+		if err := installKubePackages(vmName, to, "kubeadm"); err != nil {
+			return err
+		}
+		if out, err := RunCmd(vmName, []string{"sudo", "kubeadm", "upgrade", "node"}); err != nil {
+			Logger.Error("kubeadm upgrade node failed", "err", err, "output", out, "instance-name", vmName)
+			return err
+		}
+	}
+	if err := installKubePackages(vmName, to, "kubelet", "kubectl"); err != nil {
+		return err
+	}
+	restartCmd := []string{"sudo", "sh", "-c", "systemctl daemon-reload && systemctl restart kubelet"}
+	if out, err := RunCmd(vmName, restartCmd); err != nil {
+		Logger.Error("unable to restart kubelet", "err", err, "output", out, "instance-name", vmName)
+		return err
+	}
+	return nil
+}
+
+// waitAPIHealthy waits until the kube API is healthy behind the cluster endpoint: all the kube API backends of every LB
+// node must be up and, in kube-vip mode or with a LB pair, the API must answer ready on the virtual IP.
+func (cluster *Cluster) waitAPIHealthy(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if cluster.LBMode != LBModeKubeVIP {
+		for _, lbName := range cluster.LBNames() {
+			if err := waitLBBackendsUp(cluster.LoadBalancer(), lbName, time.Until(deadline)); err != nil {
+				Logger.Warn("kube API backends are not all up", "err", err, "instance-name", lbName)
+				return err
+			}
+		}
+		if !cluster.LBHighAvailability {
+			return nil
+		}
+	}
+	for !apiReachable(cluster.PublicAPIEndpoint) {
+		if time.Now().After(deadline) {
+			return ErrAPIUnreachable
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return nil
+}
+
+// waitLBBackendsUp waits until all the kube API servers of the LB are up, or the timeout expires.
+func waitLBBackendsUp(lb LoadBalancer, lbName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		backends, err := lb.Backends(lbName)
+		if err == nil && kubeAPIBackendsUp(backends) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrLBBackendsDown
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestParseKubeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    KubeVersion
+		wantErr bool
+	}{
+		{name: "version_good", version: "1.26.3", want: KubeVersion{1, 26, 3}, wantErr: false},
+		{name: "version_prefixed", version: "v1.25.5", want: KubeVersion{1, 25, 5}, wantErr: false},
+		{name: "version_missing_patch", version: "1.26", want: KubeVersion{}, wantErr: true},
+		{name: "version_not_a_number", version: "1.x.y", want: KubeVersion{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKubeVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseKubeVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseKubeVersion() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUpgradePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    KubeVersion
+		to      KubeVersion
+		wantErr bool
+	}{
+		{name: "upgrade_patch", from: KubeVersion{1, 25, 5}, to: KubeVersion{1, 25, 9}, wantErr: false},
+		{name: "upgrade_next_minor", from: KubeVersion{1, 25, 5}, to: KubeVersion{1, 26, 0}, wantErr: false},
+		{name: "upgrade_skip_minor", from: KubeVersion{1, 25, 5}, to: KubeVersion{1, 27, 1}, wantErr: true},
+		{name: "upgrade_same_version", from: KubeVersion{1, 25, 5}, to: KubeVersion{1, 25, 5}, wantErr: true},
+		{name: "upgrade_downgrade", from: KubeVersion{1, 26, 1}, to: KubeVersion{1, 25, 9}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkUpgradePath(tt.from, tt.to); (err != nil) != tt.wantErr {
+				t.Errorf("checkUpgradePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKubeVersion_pkgs(t *testing.T) {
+	version := KubeVersion{1, 26, 3}
+	if got := version.pkgsRepository(); got != "https://pkgs.k8s.io/core:/stable:/v1.26/deb/" {
+		t.Errorf("pkgsRepository() = %v", got)
+	}
+	if got := version.pkgsVersion(); got != "1.26.3-1.1" {
+		t.Errorf("pkgsVersion() = %v, want 1.26.3-1.1", got)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ynachi/kmpass/app"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runSubcommand runs the kmpass subcommand name with its arguments. Returns false if name is not a subcommand, in
+// which case the arguments are the cluster creation flags.
+func runSubcommand(name string, args []string) bool {
+	switch name {
+	case "doctor":
+		doctorCmd(args)
+	case "collect-logs":
+		collectLogsCmd(args)
+	case "upgrade":
+		upgradeCmd(args)
+	case "snapshot":
+		snapshotCmd(args, false)
+	case "restore":
+		snapshotCmd(args, true)
+	case "etcd":
+		etcdCmd(args)
+	case "failover-test":
+		failoverTestCmd(args)
+	case "lb-sync":
+		lbSyncCmd(args)
+	case "addons":
+		addonsCmd(args)
+	case "ingress":
+		ingressCmd(args)
+	case "service-lb":
+		serviceLBCmd(args)
+	case "cache":
+		cacheCmd(args)
+	case "load-image":
+		loadImageCmd(args)
+	case "ssh-config":
+		sshConfigCmd(args)
+	case "status":
+		statusCmd(args)
+	case "scale":
+		scaleCmd(args)
+	case "start":
+		startStopCmd(args, true)
+	case "stop":
+		startStopCmd(args, false)
+	default:
+		return false
+	}
+	return true
+}
+
+// doctorCmd diagnoses the host and a cluster. Exits with a non 0 status if any check failed.
+func doctorCmd(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster to diagnose.")
+	jsonOutput := fs.Bool("json", false, "Print the report as JSON.")
+	_ = fs.Parse(args)
+
+	// keep the report readable, only errors are logged
+	app.SetLogLevel(app.Error)
+	report := app.Diagnose(*clusterName)
+	if *jsonOutput {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, check := range report.Checks {
+			fmt.Printf("[%s] %-18s %-28s %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Target,
+				check.Message)
+			if check.Fix != "" {
+				fmt.Printf("       fix: %s\n", check.Fix)
+			}
+		}
+	}
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// loadCluster loads the state of the cluster targeted by a subcommand or exits.
+func loadCluster(clusterName string) *app.Cluster {
+	cluster, err := app.LoadState(clusterName)
+	if err != nil {
+		app.Logger.Error("cannot load cluster state", "err", err, "cluster", clusterName)
+		os.Exit(1)
+	}
+	return cluster
+}
+
+// collectLogsCmd gathers logs and configurations from every node of a cluster in a tar.gz archive.
+func collectLogsCmd(args []string) {
+	fs := flag.NewFlagSet("collect-logs", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster to collect the logs from.")
+	outDir := fs.String("o", "", "Directory in which the archive is written. Defaults to the cluster directory.")
+	parallel := fs.Int("parallel", 3, "Number of vms to collect the logs from concurrently.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	archivePath, err := cluster.CollectLogs(*outDir, *parallel)
+	if err != nil {
+		app.Logger.Error("logs collection failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	fmt.Println(archivePath)
+}
+
+// upgradeCmd performs a rolling upgrade of a cluster to a newer kubernetes version.
+func upgradeCmd(args []string) {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster to upgrade.")
+	target := fs.String("to", "", "Kubernetes version to upgrade to, eg: 1.26.3. Minor versions cannot be skipped.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	if *target == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cluster := loadCluster(*clusterName)
+	if err := cluster.Upgrade(*target); err != nil {
+		app.Logger.Error("cluster upgrade failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+}
+
+// snapshotCmd takes a snapshot of a cluster, or restores it if restore is true. Usage: kmpass snapshot <cluster> <name>
+func snapshotCmd(args []string, restore bool) {
+	action := "snapshot"
+	if restore {
+		action = "restore"
+	}
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kmpass %s <cluster> <name>\n", action)
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(fs.Arg(0))
+	var err error
+	if restore {
+		err = cluster.Restore(fs.Arg(1))
+	} else {
+		err = cluster.Snapshot(fs.Arg(1))
+	}
+	if err != nil {
+		app.Logger.Error("cluster "+action+" failed", "err", err, "cluster", cluster.Name, "snapshot", fs.Arg(1))
+		os.Exit(1)
+	}
+}
+
+// etcdCmd backs up the etcd database of a cluster to the host or restores it.
+// Usage: kmpass etcd backup [-cluster name] | kmpass etcd restore [-cluster name] <file>
+func etcdCmd(args []string) {
+	if len(args) == 0 || (args[0] != "backup" && args[0] != "restore") {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass etcd backup|restore [-cluster name] [snapshot file]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("etcd "+args[0], flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	_ = fs.Parse(args[1:])
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	if args[0] == "backup" {
+		snapshotPath, err := cluster.BackupEtcd()
+		if err != nil {
+			app.Logger.Error("etcd backup failed", "err", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+		fmt.Println(snapshotPath)
+		return
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass etcd restore [-cluster name] <snapshot file>")
+		os.Exit(2)
+	}
+	if err := cluster.RestoreEtcd(fs.Arg(0)); err != nil {
+		app.Logger.Error("etcd restore failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+}
+
+// failoverTestCmd stops the active load balancer of a highly available cluster and checks the kube API stays
+// reachable through the virtual IP.
+func failoverTestCmd(args []string) {
+	fs := flag.NewFlagSet("failover-test", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster to test.")
+	timeout := fs.Duration("timeout", 30*time.Second, "Maximum time the kube API can stay unreachable.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	downtime, err := cluster.FailoverTest(*timeout)
+	if err != nil {
+		app.Logger.Error("failover test failed", "err", err, "cluster", cluster.Name, "downtime", downtime.String())
+		os.Exit(1)
+	}
+	fmt.Printf("failover test passed, kube API unreachable for %s\n", downtime.Round(time.Millisecond))
+}
+
+// lbSyncCmd re-renders the load balancer configuration from the current node IPs and reloads it if it changed.
+func lbSyncCmd(args []string) {
+	fs := flag.NewFlagSet("lb-sync", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	changed, err := cluster.SyncLB()
+	if err != nil {
+		app.Logger.Error("load balancer sync failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	if changed {
+		fmt.Println("load balancer configuration updated")
+		return
+	}
+	fmt.Println("load balancer configuration up to date")
+}
+
+// addonsCmd lists the addons of a cluster or enables some of them.
+// Usage: kmpass addons list [-cluster name] | kmpass addons enable [-cluster name] <addon>...
+func addonsCmd(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "enable") {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass addons list|enable [-cluster name] [addon...]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("addons "+args[0], flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	_ = fs.Parse(args[1:])
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	if args[0] == "list" {
+		app.SetLogLevel(app.Error)
+		fmt.Printf("%-24s %-10s %-8s %s\n", "NAME", "INSTALLED", "HEALTHY", "DESCRIPTION")
+		for _, status := range cluster.AddonsStatus() {
+			healthy := "-"
+			if status.Installed {
+				healthy = fmt.Sprint(status.Healthy)
+			}
+			fmt.Printf("%-24s %-10t %-8s %s\n", status.Addon.Name, status.Installed, healthy, status.Addon.Description)
+		}
+		return
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass addons enable [-cluster name] <addon>...")
+		os.Exit(2)
+	}
+	if err := cluster.EnableAddons(fs.Args()...); err != nil {
+		app.Logger.Error("addons installation failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+}
+
+// ingressCmd deploys an ingress controller on the workers of a cluster and checks it answers through the LB.
+func ingressCmd(args []string) {
+	fs := flag.NewFlagSet("ingress", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	controller := fs.String("controller", "nginx", "Ingress controller: nginx or cilium.")
+	validate := fs.Bool("validate", false, "Only check the installed ingress controller answers through the LB.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	var err error
+	if *validate {
+		err = cluster.ValidateIngress()
+	} else {
+		err = cluster.InstallIngress(*controller)
+	}
+	if err != nil {
+		app.Logger.Error("ingress failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	fmt.Println("ingress controller answers through the load balancer")
+}
+
+// serviceLBCmd gives the LoadBalancer services of a cluster routable IPs from the host.
+func serviceLBCmd(args []string) {
+	fs := flag.NewFlagSet("service-lb", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	provider := fs.String("provider", "", "cilium or metallb. Defaults to cilium when the cluster was created with "+
+		"-kube-proxy-replacement, metallb otherwise.")
+	ipRange := fs.String("range", "", "Address range of the services, eg: 10.1.1.200-10.1.1.220. Should be free "+
+		"addresses of the multipass subnet. Chosen outside the multipass DHCP pool if empty, which fails when the "+
+		"pool spans the whole subnet.")
+	size := fs.Int("size", 16, "Number of addresses of the range when it is chosen automatically.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	if err := cluster.InstallServiceLB(*provider, *ipRange, *size); err != nil {
+		app.Logger.Error("service LB installation failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	fmt.Printf("LoadBalancer services get their IP from %s (%s)\n", cluster.ServiceLBRange, cluster.ServiceLBProvider)
+}
+
+// cacheCmd downloads the artifacts of the offline mode to the host. Usage: kmpass cache pull [-version 1.25.5]
+func cacheCmd(args []string) {
+	if len(args) == 0 || args[0] != "pull" {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass cache pull [-version version] [-image release] [-images image,...]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("cache pull", flag.ExitOnError)
+	version := fs.String("version", app.DefaultKubernetesVersion, "Kubernetes version of the artifacts.")
+	image := fs.String("image", "20.04", "Ubuntu release of the nodes, only the packages missing from it are cached.")
+	images := fs.String("images", "", "Comma separated list of extra images to cache, eg: nginx:1.25,ghcr.io/org/app:v1.")
+	_ = fs.Parse(args[1:])
+
+	app.SetLogLevel(app.Info)
+	var extraImages []string
+	if *images != "" {
+		extraImages = strings.Split(*images, ",")
+	}
+	cacheDir, err := app.PullArtifacts(*version, *image, extraImages)
+	if err != nil {
+		app.Logger.Error("artifacts download failed", "err", err, "version", *version)
+		os.Exit(1)
+	}
+	fmt.Println(cacheDir)
+}
+
+// loadImageCmd side-loads host images in the nodes of a cluster.
+// Usage: kmpass load-image [-cluster name] [-pool control|worker|<worker pool>] [-parallel n] <tarball>|<image>...
+func loadImageCmd(args []string) {
+	fs := flag.NewFlagSet("load-image", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	pool := fs.String("pool", "", "Only load the images on the control nodes, all the worker nodes or the nodes of a "+
+		"named worker pool, eg: cmp. All the nodes if empty.")
+	parallel := fs.Int("parallel", 3, "Number of nodes to load the images on concurrently.")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass load-image [-cluster name] [-pool control|worker|<worker pool>] "+
+			"[-parallel n] <tarball>|<image>...")
+		os.Exit(2)
+	}
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	results, err := cluster.LoadImage(fs.Args(), *pool, *parallel)
+	failed := err != nil
+	for _, result := range results {
+		if result.Err != nil {
+			failed = true
+			fmt.Printf("%-28s failed: %v\n", result.Node, result.Err)
+			continue
+		}
+		fmt.Printf("%-28s loaded\n", result.Node)
+	}
+	if err != nil {
+		app.Logger.Error("images loading failed", "err", err, "cluster", cluster.Name,
+			"worker-pools", strings.Join(cluster.WorkerPoolNames(), ","))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// sshConfigCmd writes an ssh_config snippet with the current IPs of the VMs of a cluster.
+func sshConfigCmd(args []string) {
+	fs := flag.NewFlagSet("ssh-config", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	jump := fs.Bool("jump", false, "Reach the VMs through the first load-balancer node with ProxyJump.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	sshConfigPath, err := cluster.WriteSSHConfig(*jump)
+	if err != nil {
+		app.Logger.Error("cannot write the ssh config", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	fmt.Println(sshConfigPath)
+}
+
+// statusCmd prints the nodes of a cluster with their labels and taints. Exits with a non 0 status if a node misses
+// a label or a taint of its pool.
+func statusCmd(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Error)
+	cluster := loadCluster(*clusterName)
+	nodes, err := cluster.NodesStatus()
+	if err != nil {
+		app.Logger.Error("cannot get the nodes status", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	failed := false
+	fmt.Printf("%-24s %-8s %-6s %-40s %s\n", "NAME", "POOL", "READY", "LABELS", "TAINTS")
+	for _, node := range nodes {
+		var labels, taints []string
+		for key, value := range node.Labels {
+			if !strings.Contains(key, "kubernetes.io/") && !strings.Contains(key, "k8s.io/") {
+				labels = append(labels, key+"="+value)
+			}
+		}
+		sort.Strings(labels)
+		for _, taint := range node.Taints {
+			taints = append(taints, taint.String())
+		}
+		fmt.Printf("%-24s %-8s %-6t %-40s %s\n", node.Name, node.Pool, node.Ready, strings.Join(labels, ","),
+			strings.Join(taints, ","))
+		if len(node.MissingLabels) > 0 || len(node.MissingTaints) > 0 {
+			failed = true
+			fmt.Printf("  missing: %s\n", strings.Join(append(node.MissingLabels, node.MissingTaints...), ","))
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// scaleCmd changes the number of nodes of a worker pool of a cluster.
+// Usage: kmpass scale [-cluster name] [-pool name] [-parallel n] -nodes n
+func scaleCmd(args []string) {
+	fs := flag.NewFlagSet("scale", flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	pool := fs.String("pool", "cmp", "Worker pool to scale. cmp is the pool of the -wnodes workers.")
+	nodes := fs.Int("nodes", -1, "Number of nodes of the pool.")
+	parallel := fs.Int("parallel", 1, "Number of vms to create concurrently.")
+	_ = fs.Parse(args)
+
+	if *nodes < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: kmpass scale [-cluster name] [-pool name] [-parallel n] -nodes n")
+		os.Exit(2)
+	}
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	if err := cluster.ScalePool(*pool, *nodes, *parallel); err != nil {
+		app.Logger.Error("worker pool scaling failed", "err", err, "cluster", cluster.Name, "pool", *pool)
+		os.Exit(1)
+	}
+}
+
+// startStopCmd starts or stops all the VMs of a cluster, in order.
+func startStopCmd(args []string, start bool) {
+	action := "stop"
+	if start {
+		action = "start"
+	}
+	fs := flag.NewFlagSet(action, flag.ExitOnError)
+	clusterName := fs.String("cluster", "cluster100", "Name of the kubernetes cluster.")
+	_ = fs.Parse(args)
+
+	app.SetLogLevel(app.Info)
+	cluster := loadCluster(*clusterName)
+	var err error
+	if start {
+		err = cluster.Start()
+	} else {
+		err = cluster.Stop()
+	}
+	if err != nil {
+		app.Logger.Error("cluster "+action+" failed", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/ynachi/kmpass/app"
@@ -8,6 +9,9 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && runSubcommand(os.Args[1], os.Args[2:]) {
+		return
+	}
 	clusterName := flag.String("cluster", "cluster100", "Name of the kubernetes cluster to deploy.")
 	podSubnet := flag.String("pod-subnet", "10.200.0.0/16",
 		"Subnet used by pods. Note that this is different from the node's subnet.")
@@ -34,6 +38,42 @@ func main() {
 		"Can be generated using kubeadm certs certificate-key or just use something that matches the format of the"+
 		"default key.")
 	parallel := flag.Int("parallel", 1, "Number of vms to create concurrently.")
+	specPath := flag.String("spec", "", "Path to a JSON cluster spec file. Its fields override the command line flags.")
+	lbHA := flag.Bool("lb-ha", false, "Deploy a pair of load-balancer nodes sharing a virtual IP with keepalived.")
+	virtualIP := flag.String("vip", "", "Virtual IP of the load-balancer pair. Should be a free address of the multipass"+
+		" subnet. Chosen automatically if empty. Only used with -lb-ha or -lb-mode kube-vip.")
+	lbStatsPort := flag.Int("lb-stats-port", 8404, "Port of the load-balancer stats page.")
+	lbStatsUser := flag.String("lb-stats-user", "admin", "User of the load-balancer stats page. The password is "+
+		"generated per cluster.")
+	lbBalance := flag.String("lb-balance", "roundrobin", "Balance algorithm of the load-balancer backends: "+
+		"roundrobin or leastconn.")
+	storage := flag.String("storage", "", "Default StorageClass backed by an NFS export of the first load-balancer "+
+		"node (lb) or of a dedicated VM (vm). None if empty.")
+	storageDisk := flag.String("sdisk", "20G", "Storage VM disk size. Support k/K, m/M, g/G suffixes. Only used with "+
+		"-storage vm.")
+	registry := flag.String("registry", "", "Local container registry trusted by the nodes, on the first load-balancer "+
+		"node (lb) or on a dedicated VM (vm). None if empty.")
+	offline := flag.String("offline", "", "Install the nodes from the host artifact cache of this kubernetes version, "+
+		"downloaded with kmpass cache pull, eg: 1.25.5. The nodes are installed from the internet if empty.")
+	artifactsAddr := flag.String("artifacts-addr", "", "Address of the host artifact server in offline mode, "+
+		"reachable from the VMs. Defaults to the multipass network of the host, port 8775.")
+	registryMirrors := flag.String("registry-mirrors", "", "Registry mirrors of the nodes, pulled from before the "+
+		"upstream registry, as a comma separated list of registry=endpoint, eg: docker.io=https://mirror.gcr.io.")
+	pullCache := flag.Bool("pull-cache", false, "Run a pull-through cache of docker.io, registry.k8s.io, quay.io and "+
+		"ghcr.io on the first load-balancer node, so that images are downloaded once per cluster.")
+	ingress := flag.String("ingress", "", "Ingress controller deployed on the workers behind the load-balancer 80 and "+
+		"443 listeners: nginx or cilium, which needs -kube-proxy-replacement. None if empty.")
+	serviceLB := flag.Bool("service-lb", false, "Support services of type LoadBalancer with an address range of the "+
+		"multipass subnet, using Cilium LB-IPAM with -kube-proxy-replacement, MetalLB otherwise. kube-proxy is left "+
+		"untouched.")
+	serviceLBRange := flag.String("service-lb-range", "", "Address range of the LoadBalancer services, eg: "+
+		"10.1.1.200-10.1.1.220. Chosen outside the multipass DHCP pool if empty, which fails when the pool spans the "+
+		"whole subnet.")
+	kubeProxyReplacement := flag.Bool("kube-proxy-replacement", false, "Install Cilium as the kube-proxy replacement, "+
+		"kube-proxy is not deployed. Needed by -service-lb with Cilium LB-IPAM and -ingress cilium. Cannot be changed "+
+		"after the creation.")
+	lbMode := flag.String("lb-mode", "haproxy", "Load balancing of the kube API: haproxy, nginx or envoy on a dedicated "+
+		"VM, or kube-vip on the control nodes.")
 	flag.Parse()
 
 	//@TODO We will use environment variable for the log level
@@ -41,28 +81,77 @@ func main() {
 
 	// 1. Create a cluster configuration
 	fmt.Println("------ step 1 ------------")
+	mirrors, err := app.ParseRegistryMirrors(*registryMirrors)
+	if err != nil {
+		app.Logger.Error("invalid registry mirrors", "err", err, "registry-mirrors", *registryMirrors)
+		os.Exit(1)
+	}
 	cluster := &app.Cluster{
-		Name:              *clusterName,
-		PodSubnet:         *podSubnet,
-		CtrlNodesNumber:   *ctrlNodesNumber,
-		CmpNodesNumber:    *workerNodesNumber,
-		CtrlNodesMemory:   *ctrlMemory,
-		CmpNodesMemory:    *workerMemory,
-		CmpNodesCores:     *workerCores,
-		CmpNodesDiskSize:  *workerDisk,
-		CtrlNodesDiskSize: *ctrlDisk,
-		CtrlNodesCores:    *ctrlCores,
-		LBNodeMemory:      *lbMemory,
-		Image:             *image,
-		LBNodeCore:        *lbCores,
-		LBNodeDiskSize:    *lbDisk,
-		BootstrapToken:    *bootstrapToken,
-		KubernetesCertKey: *masterJoinKey,
+		Name:                 *clusterName,
+		PodSubnet:            *podSubnet,
+		CtrlNodesNumber:      *ctrlNodesNumber,
+		CmpNodesNumber:       *workerNodesNumber,
+		CtrlNodesMemory:      *ctrlMemory,
+		CmpNodesMemory:       *workerMemory,
+		CmpNodesCores:        *workerCores,
+		CmpNodesDiskSize:     *workerDisk,
+		CtrlNodesDiskSize:    *ctrlDisk,
+		CtrlNodesCores:       *ctrlCores,
+		LBNodeMemory:         *lbMemory,
+		Image:                *image,
+		Ingress:              *ingress,
+		Storage:              *storage,
+		StorageDiskSize:      *storageDisk,
+		Registry:             *registry,
+		RegistryMirrors:      mirrors,
+		PullCache:            *pullCache,
+		ServiceLBRange:       *serviceLBRange,
+		KubeProxyReplacement: *kubeProxyReplacement,
+		LBNodeCore:           *lbCores,
+		LBNodeDiskSize:       *lbDisk,
+		BootstrapToken:       *bootstrapToken,
+		KubernetesCertKey:    *masterJoinKey,
+		LBHighAvailability:   *lbHA,
+		VirtualIP:            *virtualIP,
+		LBMode:               *lbMode,
+		LB: app.LBConfig{
+			StatsPort: *lbStatsPort,
+			StatsUser: *lbStatsUser,
+			Balance:   *lbBalance,
+		},
+	}
+	if *specPath != "" {
+		if err := cluster.LoadSpec(*specPath); err != nil {
+			app.Logger.Error("invalid cluster spec", "err", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
 	}
 	if err := cluster.ValidateConfig(); err != nil {
 		app.Logger.Error("invalid cluster object", app.ErrClusterConfiguration, "cluster", cluster.Name)
 		os.Exit(1)
 	}
+	cluster.InheritState()
+	if *offline != "" {
+		if err := cluster.ValidateOffline(); err != nil {
+			app.Logger.Error("invalid offline cluster", "err", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+		if *serviceLB && !cluster.KubeProxyReplacement {
+			// the service LB falls back to MetalLB, which downloads its manifest
+			app.Logger.Error("invalid offline cluster", "err", app.ErrOfflineFeature, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+	}
+	if err := cluster.SaveState(); err != nil {
+		app.Logger.Error("cannot save cluster state", "err", err, "cluster", cluster.Name)
+		os.Exit(1)
+	}
+	if *offline != "" {
+		if err := cluster.ServeArtifacts(*offline, *artifactsAddr); err != nil {
+			app.Logger.Error("cannot serve the artifact cache", "err", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+	}
 	// 2. generate cloud init file and get its path
 	cloudInitPath, err := app.GenerateConfigCloudInit(cluster)
 	if err != nil {
@@ -70,17 +159,61 @@ func main() {
 	}
 	// 3. create vms, except LB
 	cluster.CreateKubeVMs(cloudInitPath, *parallel)
-	// 4. generate LB configs
-	lbConfPath, err := app.GenerateConfigLB(cluster)
-	if err != nil {
-		app.Logger.Error("cannot get home dir", err, "cluster", cluster.Name)
-		os.Exit(1)
+	if err := cluster.SaveState(); err != nil {
+		app.Logger.Error("cannot save cluster state", "err", err, "cluster", cluster.Name)
 	}
-	// 6. Create LB
-	_, err = cluster.CreateLB(cloudInitPath, lbConfPath)
-	if err != nil {
-		app.Logger.Error("cannot create load balancer", err)
-		os.Exit(1)
+	if cluster.LBMode == app.LBModeKubeVIP {
+		// 4-6. no LB VM, kube-vip advertises the API virtual IP from the control nodes
+		err = cluster.PrepareKubeVIP()
+		if errors.Is(err, app.ErrVMAlreadyExist) {
+			app.Logger.Warn("cluster already exist, kube-vip already deployed", "cluster", cluster.Name)
+			return
+		}
+		if err == nil {
+			err = cluster.DeployKubeVIP(fmt.Sprintf("%s-ctrl-0", cluster.Name))
+		}
+		if err != nil {
+			app.Logger.Error("cannot deploy kube-vip", "err", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+		if err := cluster.SaveState(); err != nil {
+			app.Logger.Error("cannot save cluster state", "err", err, "cluster", cluster.Name)
+		}
+	} else {
+		// 4. generate LB configs
+		lbConfPath, err := app.GenerateConfigLB(cluster)
+		if err != nil {
+			app.Logger.Error("cannot get home dir", err, "cluster", cluster.Name)
+			os.Exit(1)
+		}
+		// 6. Create LB
+		_, err = cluster.CreateLB(cloudInitPath, lbConfPath)
+		if errors.Is(err, app.ErrVMAlreadyExist) {
+			// the cluster already exist, only reconcile the LB with the current nodes
+			if _, err := cluster.SyncLB(); err != nil {
+				app.Logger.Error("cannot sync load balancer configuration", "err", err, "cluster", cluster.Name)
+				os.Exit(1)
+			}
+			app.Logger.Warn("cluster already exist, load balancer configuration synced", "cluster", cluster.Name)
+			return
+		}
+		if err != nil {
+			app.Logger.Error("cannot create load balancer", err)
+			os.Exit(1)
+		}
+		if err := cluster.SaveState(); err != nil {
+			app.Logger.Error("cannot save cluster state", "err", err, "cluster", cluster.Name)
+		}
+		if cluster.PullCache {
+			if err := cluster.SetupPullCache(); err != nil {
+				app.Logger.Error("pull-through cache installation failed", "err", err, "cluster", cluster.Name)
+			}
+		}
+		if cluster.LBMode == app.LBModeHaproxy {
+			app.Logger.Info("load balancer stats page", "url", fmt.Sprintf("http://%s:%d/stats",
+				cluster.PublicAPIEndpoint, cluster.LB.StatsPort), "user", cluster.LB.StatsUser, "password",
+				"StatsPassword of ~/kmpass/"+cluster.Name+"/state.json")
+		}
 	}
 	// 7. generate kubeadm config
 	kubeadmInitConfPath, err := app.GenerateConfigKubeadm(cluster)
@@ -106,27 +239,63 @@ func main() {
 		os.Exit(1)
 	}
 	// 10. Join the other controllers
-	ctrlJoinCMD, err := cluster.GetMasterJoinCMD()
-	if err != nil {
-		app.Logger.Error("failed to generate master join command", err, "cluster", cluster.Name)
-		os.Exit(1)
-	}
 	for i := 1; i < cluster.CtrlNodesNumber; i++ {
-		_, err = app.RunCmd(fmt.Sprintf("%s-ctrl-%d", cluster.Name, i), ctrlJoinCMD)
-		if err != nil {
-			app.Logger.Error("unable to join master node", err, "cluster", cluster.Name)
+		ctrlName := fmt.Sprintf("%s-ctrl-%d", cluster.Name, i)
+		if err := cluster.JoinNode(ctrlName); err != nil {
+			app.Logger.Error("unable to join master node", "err", err, "cluster", cluster.Name)
+			continue
+		}
+		if cluster.LBMode == app.LBModeKubeVIP {
+			if err := cluster.DeployKubeVIP(ctrlName); err != nil {
+				app.Logger.Error("cannot deploy kube-vip", "err", err, "instance-name", ctrlName)
+			}
 		}
 	}
-	// 11. Join the workers
-	workerJoinCMD, err := cluster.GetWorkerJoinCMD()
-	if err != nil {
-		app.Logger.Error("failed to generate worker join command", err, "cluster", cluster.Name)
-		os.Exit(1)
+	// 11. Join the workers, with the labels and taints of their pool
+	for _, pool := range cluster.WorkerPoolNames() {
+		nodeNames, _ := cluster.PoolNodeNames(pool)
+		for _, nodeName := range nodeNames {
+			if err := cluster.JoinNode(nodeName); err != nil {
+				app.Logger.Error("unable to join worker node", "err", err, "cluster", cluster.Name)
+			}
+		}
 	}
-	for i := 0; i < cluster.CmpNodesNumber; i++ {
-		_, err = app.RunCmd(fmt.Sprintf("%s-cmp-%d", cluster.Name, i), workerJoinCMD)
-		if err != nil {
-			app.Logger.Error("unable to join worker node", err, "cluster", cluster.Name)
+	// 12. Install the default StorageClass
+	if cluster.Storage != "" {
+		if err := cluster.SetupStorage(); err != nil {
+			app.Logger.Error("storage installation failed", "err", err, "cluster", cluster.Name)
+		}
+	}
+	// 13. Deploy the ingress controller
+	if cluster.Ingress != "" {
+		if err := cluster.InstallIngress(cluster.Ingress); err != nil {
+			app.Logger.Error("ingress controller installation failed", "err", err, "cluster", cluster.Name)
+		}
+	}
+	// 14. Support LoadBalancer services
+	if *serviceLB {
+		if err := cluster.InstallServiceLB("", cluster.ServiceLBRange, 16); err != nil {
+			app.Logger.Error("service LB installation failed", "err", err, "cluster", cluster.Name)
+		}
+	}
+	// 15. Enable the addons of the spec
+	if len(cluster.Addons) > 0 {
+		if err := cluster.EnableAddons(cluster.Addons...); err != nil {
+			app.Logger.Error("addons installation failed", "err", err, "cluster", cluster.Name)
 		}
 	}
+	// 16. Run the local registry
+	if cluster.Registry != "" {
+		if err := cluster.SetupRegistry(); err != nil {
+			app.Logger.Error("registry installation failed", "err", err, "cluster", cluster.Name)
+		} else {
+			fmt.Println(cluster.RegistryInstructions())
+		}
+	}
+	// 17. Write the ssh config of the nodes
+	if sshConfigPath, err := cluster.WriteSSHConfig(false); err != nil {
+		app.Logger.Error("cannot write the ssh config", "err", err, "cluster", cluster.Name)
+	} else {
+		app.Logger.Info("ssh config written, include it in ~/.ssh/config", "path", sshConfigPath)
+	}
 }